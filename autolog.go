@@ -0,0 +1,378 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The autologs used to be plain text files with one message per line, they
+// are now structured logs with one JSON LogRecord per line.  Both are read
+// when building the chains, only the structured logs are written to.
+const (
+	plainLogExt      = ".txt"
+	structuredLogExt = ".jsonl"
+)
+
+// Kinds of LogRecord.
+const (
+	LogKindMessage = "msg"
+	LogKindAction  = "action"
+)
+
+// LogRecord is a line of the structured autolog.  Time is when the line was
+// sent according to the server, it is zero for the lines migrated from the
+// plain text autologs, which only recorded the text.
+type LogRecord struct {
+	Time    time.Time `json:"time"`
+	Network string    `json:"network,omitempty"`
+	Channel string    `json:"channel"`
+	Nick    string    `json:"nick,omitempty"`
+	Account string    `json:"account,omitempty"`
+	Kind    string    `json:"kind"`
+	Text    string    `json:"text"`
+}
+
+// newLogRecord returns the record of a line in the legacy format, where
+// actions are prefixed with "ACTION ".
+func newLogRecord(channel, line string) LogRecord {
+	record := LogRecord{
+		Channel: channel,
+		Kind:    LogKindMessage,
+		Text:    line,
+	}
+	if strings.HasPrefix(line, "ACTION ") {
+		record.Kind = LogKindAction
+		record.Text = line[7:]
+	}
+	return record
+}
+
+// Line returns the line learned by the chain, actions are prefixed with
+// "ACTION " so the bot can generate actions of its own.
+func (record LogRecord) Line() string {
+	if record.Kind == LogKindAction {
+		return "ACTION " + record.Text
+	}
+	return record.Text
+}
+
+// encodeRecord returns the JSON line of a record, HTML characters are kept
+// as-is since they are common on IRC ("<3", "->").
+func encodeRecord(record LogRecord) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(record); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// appendRecord appends a record to the structured log filename.
+func appendRecord(filename string, record LogRecord) {
+	line, err := encodeRecord(record)
+	if err != nil {
+		log.Printf("Error encoding a record for %s: %s", filename,
+			err.Error())
+		return
+	}
+
+	logLine(filename, line)
+}
+
+// scanRecords calls fn with every record of the structured log read from r,
+// invalid records are skipped.  A last line without newline is still being
+// written, it is ignored.
+func scanRecords(r io.Reader, fn func(LogRecord)) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			break
+		}
+
+		var record LogRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			log.Printf("skipping invalid record: %s", err.Error())
+			continue
+		}
+
+		fn(record)
+	}
+}
+
+// BuildRecords reads a structured log from the provided Reader and adds its
+// lines to the Chain.  Invalid records are skipped.
+func (chain *Chain) BuildRecords(r io.Reader) {
+	scanRecords(r, func(record LogRecord) {
+		chain.AddLine(record.Line())
+	})
+}
+
+// buildDataFile adds the lines of a data file to the chain, according to its
+// format.
+func buildDataFile(chain *Chain, r io.Reader, filename string) {
+	if filepath.Ext(filename) == structuredLogExt {
+		chain.BuildRecords(r)
+	} else {
+		chain.Build(r)
+	}
+}
+
+// migrateLogs converts the plain text autologs of every model to structured
+// logs, the lines are inserted before the records already logged and the
+// plain text files are removed.  Other plain text files (e.g. corpora) are
+// left alone.
+//
+// The bot must not be running: the lines it would log during the conversion
+// would be lost.  This is checked with the file written by lockRunning.
+func migrateLogs() error {
+	if err := checkNotRunning(); err != nil {
+		return err
+	}
+
+	channels := getConfiguredChannels()
+	migrated := make(StringSet)
+
+	for _, network := range cfg.Networks {
+		_, dataPath, _ := getNetworkModelPaths(network)
+		if migrated[dataPath] {
+			continue
+		}
+		migrated.Add(dataPath)
+
+		// A shared directory is not specific to any network.
+		name := ""
+		if network.Model == ModelOwn {
+			name = network.Name
+		}
+
+		filenames, err := filepath.Glob(filepath.Join(dataPath,
+			"autolog-*"+plainLogExt))
+		if err != nil {
+			return err
+		}
+		for _, filename := range filenames {
+			if err := migrateLog(filename, name, channels); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// getConfiguredChannels returns the channels found in the configuration
+// (auto-joined or with a model of their own) by the casemapped basename of
+// their autolog.
+func getConfiguredChannels() map[string]string {
+	channels := make(map[string]string)
+	for _, network := range cfg.Networks {
+		for _, channel := range network.GetAutoJoinChannels() {
+			channels[ircLower(getLogBasename(channel))] = channel
+		}
+		for channel := range network.ChannelModels {
+			channels[ircLower(getLogBasename(channel))] = channel
+		}
+	}
+	return channels
+}
+
+// migrateLog converts a plain text autolog to a structured log of the same
+// name.  The file name only has the escaped channel name (see
+// logFilenameReplacer), the channel is looked up in the configured channels
+// and the escaped name is only kept for the others.
+func migrateLog(filename, network string, channels map[string]string) error {
+	target := strings.TrimSuffix(filename, plainLogExt) + structuredLogExt
+	log.Printf("migrating %s to %s", filename, target)
+
+	base := strings.TrimSuffix(filepath.Base(filename), plainLogExt)
+	channel, ok := channels[ircLower(base)]
+	if !ok {
+		channel = strings.TrimPrefix(base, "autolog-")
+	}
+
+	err := writeFileAtomic(target, 0660, func(w io.Writer) error {
+		return writeMigratedLog(w, filename, target, network, channel)
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(filename)
+}
+
+// writeMigratedLog writes the lines of the plain text autolog filename as
+// records of channel, followed by the records of the structured log target,
+// if any.
+func writeMigratedLog(w io.Writer, filename, target, network, channel string) error {
+	legacy, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer legacy.Close()
+
+	br := bufio.NewReader(legacy)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			record := newLogRecord(channel, line)
+			record.Network = network
+			encoded, err := encodeRecord(record)
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, encoded+"\n"); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	current, err := os.Open(target)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer current.Close()
+
+	_, err = io.Copy(w, current)
+	return err
+}
+
+// logRewrite is a structured log being rewritten without the records
+// matching, see Model.Forget.
+type logRewrite struct {
+	filename string
+	match    func(LogRecord) bool
+	file     *atomicFile
+	removed  []LogRecord
+	kept     int
+
+	// offset is how much of the log was filtered so far.
+	offset int64
+}
+
+// startLogRewrite filters the first size bytes of the structured log
+// filename, the rest is filtered by Finish.  It returns nil if none of these
+// records match.
+func startLogRewrite(filename string, size int64, match func(LogRecord) bool) (*logRewrite, error) {
+	input, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	file, err := createAtomicFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrite := &logRewrite{
+		filename: filename,
+		match:    match,
+		file:     file,
+		offset:   size,
+	}
+	err = rewrite.filter(io.LimitReader(input, size))
+	if err != nil || len(rewrite.removed) == 0 {
+		file.Abort()
+		return nil, err
+	}
+
+	return rewrite, nil
+}
+
+// startLogRewrites starts the rewrite of the structured logs among the files
+// of path, the ones with matching records.  The rewrites started are returned
+// along with any error, they are to be aborted.
+func startLogRewrites(path string, fileInfos []os.FileInfo, match func(LogRecord) bool) ([]*logRewrite, error) {
+	var rewrites []*logRewrite
+	for _, fileInfo := range fileInfos {
+		if filepath.Ext(fileInfo.Name()) != structuredLogExt {
+			continue
+		}
+
+		filename := filepath.Join(path, fileInfo.Name())
+		rewrite, err := startLogRewrite(filename, fileInfo.Size(), match)
+		if err != nil {
+			return rewrites, err
+		}
+		if rewrite != nil {
+			rewrites = append(rewrites, rewrite)
+		}
+	}
+
+	return rewrites, nil
+}
+
+// abortLogRewrites aborts the rewrites not finished.
+func abortLogRewrites(rewrites []*logRewrite) {
+	for _, rewrite := range rewrites {
+		rewrite.Abort()
+	}
+}
+
+// Finish filters the records logged since the rewrite started and replaces
+// the log.  Learning must be held meanwhile.
+func (rewrite *logRewrite) Finish() error {
+	input, err := os.Open(rewrite.filename)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	if _, err := input.Seek(rewrite.offset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := rewrite.filter(input); err != nil {
+		return err
+	}
+
+	return rewrite.file.Commit(0660)
+}
+
+// Abort leaves the log untouched, it does nothing once finished.
+func (rewrite *logRewrite) Abort() {
+	rewrite.file.Abort()
+}
+
+// filter copies the records read from r to the new log, except the matching
+// ones which are kept aside.
+func (rewrite *logRewrite) filter(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			var record LogRecord
+			if json.Unmarshal([]byte(line), &record) == nil &&
+				rewrite.match(record) {
+				rewrite.removed = append(rewrite.removed, record)
+			} else if _, err := io.WriteString(rewrite.file, line); err != nil {
+				return err
+			} else {
+				rewrite.kept++
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readRecords returns the records of a structured log.
+func readRecords(t *testing.T, filename string) []LogRecord {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []LogRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record LogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestLogRecords(t *testing.T) {
+	network, _ := setupTestBot(t)
+	at := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	network.MessageHandler(Speaker{Nick: "bob", Account: "bobby"}, "#debsquad", "le chat <3 le tapis", at)
+	network.ActionHandler(Speaker{Nick: "alice"}, "#debsquad", "caresse le chat", at)
+
+	filename := network.models.shared.getLogFilename("#debsquad")
+	records := readRecords(t, filename)
+	expected := []LogRecord{
+		{at, "test", "#debsquad", "bob", "bobby", LogKindMessage, "le chat <3 le tapis"},
+		{at, "test", "#debsquad", "alice", "", LogKindAction, "caresse le chat"},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("wrong records: %+v", records)
+	}
+	for i := range expected {
+		if records[i] != expected[i] {
+			t.Fatalf("wrong record %d: %+v", i, records[i])
+		}
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "<3") {
+		t.Fatalf("HTML characters escaped: %s", data)
+	}
+
+	chain := initializeMarkovChain(DataFiles{Path: cfg.MarkovDataPath},
+		filepath.Join(cfg.MarkovDataPath, "none.snapshot"), 2)
+	if chain.GetScoredWords("tapis")[0].Score != 1 {
+		t.Fatal("message not rebuilt from the structured log")
+	}
+	if chain.GetScoredWords("ACTION")[0].Score != 1 {
+		t.Fatal("action not rebuilt from the structured log")
+	}
+}
+
+func TestBuildRecordsSkipsInvalid(t *testing.T) {
+	chain := NewChain(2)
+	chain.BuildRecords(strings.NewReader("not json\n" +
+		`{"channel":"#debsquad","kind":"msg","text":"le chat dort"}` + "\n"))
+
+	if chain.GetScoredWords("dort")[0].Score != 1 {
+		t.Fatal("valid record skipped")
+	}
+}
+
+func TestMigrateLogs(t *testing.T) {
+	setupTestBot(t)
+	dir := cfg.MarkovDataPath
+	cfg.MarkovOrder = 2
+	cfg.SnapshotPath = filepath.Join(dir, "chain.snapshot")
+	cfg.Networks = []NetworkCfg{{Name: "oftc"}}
+	models = nil
+	t.Cleanup(func() { models = nil })
+
+	legacy := filepath.Join(dir, "autolog-#debsquad.txt")
+	corpus := filepath.Join(dir, "corpus.txt")
+	for filename, content := range map[string]string{
+		legacy: "le chat dort\nACTION caresse le chat\n",
+		corpus: "il était une fois\n",
+	} {
+		if err := ioutil.WriteFile(filename, []byte(content), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Lines logged after the switch to the structured logs come last.
+	registry := loadModels()["oftc"]
+	network := newNetwork(cfg.Networks[0], registry)
+	network.MessageHandler(Speaker{Nick: "bob"}, "#debsquad", "le chien aboie", time.Now())
+	registry.Snapshot()
+
+	if err := migrateLogs(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatal("legacy autolog not removed")
+	}
+	if _, err := os.Stat(corpus); err != nil {
+		t.Fatal("corpus migrated: ", err)
+	}
+
+	records := readRecords(t, registry.shared.getLogFilename("#debsquad"))
+	if len(records) != 3 {
+		t.Fatalf("wrong records: %+v", records)
+	}
+	if records[0].Text != "le chat dort" || !records[0].Time.IsZero() ||
+		records[0].Channel != "#debsquad" {
+		t.Fatalf("wrong migrated record: %+v", records[0])
+	}
+	if records[1].Kind != LogKindAction || records[1].Text != "caresse le chat" {
+		t.Fatalf("wrong migrated action: %+v", records[1])
+	}
+	if records[2].Nick != "bob" {
+		t.Fatalf("wrong logged record: %+v", records[2])
+	}
+
+	// The snapshot refers to the legacy autolog, the chain is rebuilt
+	// without learning the migrated lines twice.
+	models = nil
+	chain := loadModels()["oftc"].shared.Chain
+	for word, count := range map[string]uint64{
+		"dort":  1,
+		"chien": 1,
+		"fois":  1,
+	} {
+		if score := chain.GetScoredWords(word)[0].Score; score != count {
+			t.Fatalf("wrong count for %s after migration: %d", word, score)
+		}
+	}
+}
+
+func TestMigrateLogsChannelNames(t *testing.T) {
+	setupTestBot(t)
+	dir := cfg.MarkovDataPath
+	cfg.Networks = []NetworkCfg{{Name: "oftc", Channels: []string{"#a/b"}}}
+
+	for _, name := range []string{"autolog-#A_B", "autolog-#c_d"} {
+		filename := filepath.Join(dir, name+plainLogExt)
+		if err := ioutil.WriteFile(filename, []byte("le chat dort\n"), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Lines would be lost while the bot runs.
+	if err := lockRunning(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateLogs(); err == nil {
+		t.Fatal("migrated while running")
+	}
+	unlockRunning()
+
+	if err := migrateLogs(); err != nil {
+		t.Fatal(err)
+	}
+	for name, channel := range map[string]string{
+		"autolog-#A_B": "#a/b",
+		"autolog-#c_d": "#c_d",
+	} {
+		records := readRecords(t, filepath.Join(dir, name+structuredLogExt))
+		if len(records) != 1 || records[0].Channel != channel {
+			t.Fatalf("wrong records migrated from %s: %+v", name, records)
+		}
+	}
+}
+
+func TestLogRewrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "autolog-#debsquad.jsonl")
+	logRecords := func(nicks ...string) {
+		for _, nick := range nicks {
+			appendRecord(filename, LogRecord{Channel: "#debsquad",
+				Nick: nick, Kind: LogKindMessage, Text: "le chat dort"})
+		}
+	}
+	isBob := func(record LogRecord) bool { return record.Nick == "bob" }
+
+	logRecords("alice", "carol")
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrite, err := startLogRewrite(filename, fileInfo.Size(), isBob)
+	if rewrite != nil || err != nil {
+		t.Fatalf("rewrite without matching records: %v", err)
+	}
+
+	logRecords("bob", "alice")
+	fileInfo, err = os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrite, err = startLogRewrite(filename, fileInfo.Size(), isBob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The records logged while filtering are filtered when finishing.
+	logRecords("bob", "carol")
+	if err := rewrite.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	var nicks []string
+	for _, record := range readRecords(t, filename) {
+		nicks = append(nicks, record.Nick)
+	}
+	if strings.Join(nicks, " ") != "alice carol alice carol" ||
+		len(rewrite.removed) != 2 {
+		t.Fatalf("wrong rewrite: %v, %d removed", nicks,
+			len(rewrite.removed))
+	}
+
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(filename), ".*"))
+	if err != nil || len(matches) != 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// wantedCaps are the IRCv3 capabilities requested when the server supports
+// them, "sasl" is added when SASL is configured.
+var wantedCaps = []string{
+	"message-tags",
+	"server-time",
+	"account-tag",
+	"echo-message",
+}
+
+// echoTimeout is how long we wait for the server to echo a message back
+// (echo-message) before considering it lost.
+const echoTimeout = 30 * time.Second
+
+// pendingEcho is a message sent to the server, waiting for its echo.
+type pendingEcho struct {
+	target string
+	text   string
+	sent   time.Time
+}
+
+// handleCAP negotiates the capabilities: the server lists them (CAP LS,
+// possibly over several lines), we request the ones we want (CAP REQ) and
+// resume the registration (CAP END) once they are acknowledged, or after the
+// SASL exchange.
+func (t *nativeTransport) handleCAP(msg *Message) {
+	// CAP <nick> <subcommand> [*] :<capabilities>
+	caps := strings.Fields(msg.Trailing())
+	more := len(msg.Params) > 3 && msg.Param(2) == "*"
+
+	switch msg.Param(1) {
+	case "LS":
+		t.mutex.Lock()
+		for _, c := range caps {
+			// CAP LS 302 may list values (e.g. sasl=PLAIN).
+			name := strings.SplitN(c, "=", 2)[0]
+			t.availableCaps.Add(name)
+		}
+		available := t.availableCaps
+		t.mutex.Unlock()
+
+		if more {
+			return
+		}
+
+		wanted := wantedCaps
+		if t.options.SASLMechanism != "" {
+			wanted = append(wanted[:len(wanted):len(wanted)], "sasl")
+		}
+
+		var request []string
+		for _, c := range wanted {
+			if available[c] {
+				request = append(request, c)
+			}
+		}
+
+		if t.options.SASLMechanism != "" && !available["sasl"] {
+			log.Printf("SASL not supported by the server")
+		}
+
+		if len(request) == 0 {
+			t.send("CAP END")
+			return
+		}
+		t.send("CAP REQ :" + strings.Join(request, " "))
+
+	case "ACK":
+		t.mutex.Lock()
+		for _, c := range caps {
+			t.caps.Add(c)
+		}
+		sasl := t.caps["sasl"]
+		t.mutex.Unlock()
+
+		if more {
+			return
+		}
+
+		log.Printf("capabilities enabled: %s", strings.Join(caps, " "))
+		if sasl && t.options.SASLMechanism != "" {
+			t.send("AUTHENTICATE " + t.options.SASLMechanism)
+			return
+		}
+		t.send("CAP END")
+
+	case "NAK":
+		log.Printf("capabilities refused: %s", msg.Trailing())
+		if t.options.SASLMechanism != "" {
+			log.Printf("SASL not supported by the server")
+		}
+		t.send("CAP END")
+	}
+}
+
+// hasCap returns true if the capability was enabled on this connection.
+func (t *nativeTransport) hasCap(name string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.caps[name]
+}
+
+// expectEcho records a message sent to target, to be confirmed by its echo if
+// echo-message is enabled.
+func (t *nativeTransport) expectEcho(target, text string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.caps["echo-message"] {
+		return
+	}
+
+	now := time.Now()
+	t.pruneEchoes(now)
+	t.pendingEchoes = append(t.pendingEchoes, pendingEcho{
+		target: target,
+		text:   strings.TrimRightFunc(text, unicode.IsSpace),
+		sent:   now,
+	})
+}
+
+// confirmEcho matches the echo of a message we sent.
+func (t *nativeTransport) confirmEcho(target, text string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	t.pruneEchoes(now)
+	for i, p := range t.pendingEchoes {
+		if strings.EqualFold(p.target, target) && p.text == text {
+			log.Printf("message to %s delivered in %s", target,
+				now.Sub(p.sent))
+			t.pendingEchoes = append(t.pendingEchoes[:i],
+				t.pendingEchoes[i+1:]...)
+			return
+		}
+	}
+
+	log.Printf("unexpected echo to %s: %s", target,
+		redactPrivmsg(target, text))
+}
+
+// pruneEchoes reports as lost the messages waiting for their echo for too
+// long.  It runs on every message sent or echoed and on every PING, so the
+// losses are reported even once the bot went quiet.  The caller holds
+// t.mutex.
+func (t *nativeTransport) pruneEchoes(now time.Time) {
+	pending := t.pendingEchoes[:0]
+	for _, p := range t.pendingEchoes {
+		if now.Sub(p.sent) > echoTimeout {
+			log.Printf("message to %s not delivered: %s", p.target,
+				redactPrivmsg(p.target, p.text))
+			continue
+		}
+		pending = append(pending, p)
+	}
+	t.pendingEchoes = pending
+}
+
+// undelivered returns the number of messages waiting for their echo.
+func (t *nativeTransport) undelivered() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.pendingEchoes)
+}
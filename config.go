@@ -7,36 +7,147 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 )
 
-// Cmd is a singleton storing all the command-line parameters.
+// Cmd is a singleton storing all the command-line parameters.  Without
+// command, the bot connects to the configured networks.
 type Cmd struct {
 	ConfigFile string `short:"c" description:"Configuration file" default:"/etc/paglop.conf"`
+
+	MigrateLogs struct{}  `command:"migrate-logs" description:"Convert the plain text autologs to structured logs (the bot must be stopped)"`
+	Import      ImportCmd `command:"import" description:"Convert the logs of an IRC client or bouncer to a structured log"`
 }
 
-// Cfg is a singleton storing all the config file parameters.
-type Cfg struct {
-	// In Test-mode, this program will not attempt to communicate with any
-	// external systems (e.g. SQS and will print everything to stdout).
-	// Additionally, all delays are reduced to a minimum to speed up the
-	// test suite.
-	TestMode bool
+// Commands, see Cmd.
+const (
+	CommandMigrateLogs = "migrate-logs"
+	CommandImport      = "import"
+)
+
+// Markov models a network can learn into, see NetworkCfg.Model.
+const (
+	ModelShared = "shared"
+	ModelOwn    = "own"
+)
+
+// NetworkCfg defines an IRC network the bot connects to.
+type NetworkCfg struct {
+	// Name identifies the network in the logs and the secrets file, and
+	// names the directory of its own model.
+	Name string
 
 	// IRCNickname is the nickname of the bot, passed upon connction.
 	IRCNickname string
 
+	// NickServRecoverCommand is how the bot gets its nick back when it
+	// is taken: "GHOST" (the default, followed by a NICK) or "REGAIN".
+	// The NickServ password comes from the secrets file.
+	NickServRecoverCommand string
+
+	// NickRegainInterval defines how often the bot tries to get its nick
+	// back (e.g. "5m"), "0" disables it.
+	NickRegainInterval string
+
 	// IRCServer is the hostname and port of the IRC server.
 	IRCServer string
 
+	// Transport selects the IRC client implementation: "ircevent" (the
+	// default, based on go-ircevent) or "native" (built-in client).
+	Transport string
+
+	// IRCUseTLS connects to IRCServer over TLS.
+	IRCUseTLS bool
+
+	// TLSCAFile is a PEM file with the certificate authorities trusted to
+	// sign the certificate of the server, instead of the system ones.
+	TLSCAFile string
+
+	// TLSCertFile and TLSKeyFile are the PEM client certificate and key
+	// presented to the server, used by services for CertFP and by SASL
+	// EXTERNAL.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSInsecureSkipVerify disables the verification of the certificate
+	// of the server, only use this for testing.
+	TLSInsecureSkipVerify bool
+
+	// SASLMechanism enables SASL authentication: "PLAIN" (with SASLLogin
+	// and SASLPassword) or "EXTERNAL" (with the TLS client certificate,
+	// native transport only).
+	SASLMechanism string
+	SASLLogin     string
+	SASLPassword  string
+
+	// FloodBurst is the number of lines the bot can send at once, after
+	// which it sends one line per FloodInterval (e.g. "1s").  Defaults to
+	// 4 lines and "1s".
+	FloodBurst    int
+	FloodInterval string
+
 	// Channels is the list of channels to auto-matically join.
 	Channels []string
 
-	// Any chatter from these nicks will be dropped (other bots).
+	// LearnFromPrivateMessages makes the bot learn (and log) what people
+	// tell it in private.  Disabled by default since it is mostly
+	// gibberish aimed at the bot.
+	LearnFromPrivateMessages bool
+
+	// Any chatter from these nicks will be dropped (other bots).  Entries
+	// can also be hostmask globs ("*!*@bots.example.org") or services
+	// accounts ("account:alfred").
 	Ignore []string
 
+	// Model is the markov model the network learns into and generates
+	// from: "shared" (the default) with the other networks, or "own",
+	// kept in a sub-directory of MarkovDataPath named after the network.
+	Model string
+
+	// ChannelModels sets the model of some channels, the others use the
+	// model of the network, see ChannelModelCfg.
+	ChannelModels map[string]ChannelModelCfg
+}
+
+// ChannelModelCfg defines the markov model of a channel.
+type ChannelModelCfg struct {
+	// Model is "own" for a model learned from this channel only, built
+	// from its autolog file and kept apart from the model of the network,
+	// or "shared" (the default) for the model of the network.
+	Model string
+
+	// Blend makes the channel answer from several models, weighted: for
+	// each answer, a model knowing the topic is picked according to its
+	// weight.  Models are named after their channel (which must have its
+	// own model) or "shared" for the model of the network, e.g.
+	// {"#debsquad": 3, "shared": 1}.  By default the channel answers from
+	// the model it learns into.
+	Blend map[string]int
+}
+
+// Cfg is a singleton storing all the config file parameters.
+type Cfg struct {
+	// In Test-mode, this program will not attempt to communicate with any
+	// external systems (e.g. SQS and will print everything to stdout).
+	// Additionally, all delays are reduced to a minimum to speed up the
+	// test suite.
+	TestMode bool
+
+	// The network settings can be given at the top level to connect to a
+	// single network, or as a list in Networks to connect to several
+	// networks at once.
+	NetworkCfg
+	Networks []NetworkCfg
+
+	// SecretsFilePath is the JSON file holding the passwords, see
+	// Secrets.
+	SecretsFilePath string
+
 	// Where to find the alias file. Will use the local alias file found in
 	// the current directory by default.
 	AliasFilePath string
@@ -49,9 +160,49 @@ type Cfg struct {
 
 	// MarkovDataPath defines the directory containing all the markov chain
 	// data sets to load.  This is also where the bot will save all the
-	// data it reads from the configured channels, assuming the file
-	// extentions are ".txt".
+	// data it reads from the configured channels.  Data sets are plain
+	// text (".txt", one line per message) or structured autologs
+	// (".jsonl", see LogRecord), legacy plain text autologs can be
+	// converted with the migrate-logs command while the bot is stopped.
 	MarkovDataPath string
+
+	// MarkovOrder is the number of words used as leader in the markov
+	// chain (1 to 5, defaults to 2).  Higher orders are more coherent,
+	// lower orders are more creative.
+	MarkovOrder int
+
+	// MarkovSubstringMatch makes the bot answer on any word containing the
+	// topic word (e.g. "chat" also matches "chaton").  By default only the
+	// exact word is matched.
+	MarkovSubstringMatch bool
+
+	// SnapshotPath is the file where the markov chain is saved so it can
+	// be restored quickly upon start.  Defaults to "chain.snapshot" in
+	// MarkovDataPath.  Networks with their own model keep their snapshot
+	// in their own directory, channels with their own model in
+	// "chain-<channel>.snapshot" next to their autolog.
+	SnapshotPath string
+
+	// SpeakerModels records the lines of every speaker apart, in a
+	// "speakers" directory next to the autologs, so the bot can imitate
+	// them: "paglop: imite bob <topic>".
+	SpeakerModels bool
+
+	// SpeakerMinLines is how many lines the bot needs from someone before
+	// imitating them, with less it would mostly quote them verbatim.
+	// Defaults to 100.
+	SpeakerMinLines int
+
+	// OptOutFilePath is the JSON file listing the people who asked the
+	// bot not to learn from them ("paglop: ne m'apprends pas" or
+	// "paglop: forget me").  Defaults to "optouts.json" in
+	// MarkovDataPath.
+	OptOutFilePath string
+
+	// SnapshotInterval defines how often the markov chain is saved (e.g.
+	// "10m"), in addition to the save happening upon shutdown.  Set to
+	// "0" to disable periodic snapshots.
+	SnapshotInterval string
 }
 
 var (
@@ -61,16 +212,207 @@ var (
 
 // GetAutoJoinChannels returns a list of all the auto-join channels (all unique
 // configured channels and debug channels).
-func (cfg *Cfg) GetAutoJoinChannels() []string {
+func (network *NetworkCfg) GetAutoJoinChannels() []string {
 	channels := make(StringSet, 0)
 
-	for _, name := range cfg.Channels {
+	for _, name := range network.Channels {
 		channels.Add(name)
 	}
 
 	return channels.Array()
 }
 
+// GetTransportOptions returns the connection options for the transport,
+// loading the TLS certificates if needed.
+func (network *NetworkCfg) GetTransportOptions() (TransportOptions, error) {
+	options := TransportOptions{
+		Server:        network.IRCServer,
+		Nick:          network.IRCNickname,
+		SASLMechanism: network.SASLMechanism,
+		SASLLogin:     network.SASLLogin,
+		SASLPassword:  network.SASLPassword,
+		Quiet: network.SASLPassword != "" ||
+			secrets.For(network.Name).NickServPassword != "",
+	}
+
+	if network.IRCUseTLS {
+		config, err := newTLSConfig(network.IRCServer, network.TLSCAFile,
+			network.TLSCertFile, network.TLSKeyFile,
+			network.TLSInsecureSkipVerify)
+		if err != nil {
+			return options, err
+		}
+		options.TLSConfig = config
+	}
+
+	return options, nil
+}
+
+// GetNickRegainInterval returns the parsed NickRegainInterval, a zero
+// duration means the bot does not try to regain its nick.
+func (network *NetworkCfg) GetNickRegainInterval() time.Duration {
+	interval, err := time.ParseDuration(network.NickRegainInterval)
+	if err != nil {
+		return 0
+	}
+	return interval
+}
+
+// GetFloodInterval returns the parsed FloodInterval.
+func (network *NetworkCfg) GetFloodInterval() time.Duration {
+	interval, err := time.ParseDuration(network.FloodInterval)
+	if err != nil {
+		return 0
+	}
+	return interval
+}
+
+// GetSnapshotInterval returns the parsed SnapshotInterval, a zero duration
+// means periodic snapshots are disabled.
+func (cfg *Cfg) GetSnapshotInterval() time.Duration {
+	interval, err := time.ParseDuration(cfg.SnapshotInterval)
+	if err != nil {
+		return 0
+	}
+	return interval
+}
+
+// setDefaults fills the unset network parameters and checks them.
+func (network *NetworkCfg) setDefaults() error {
+	if network.IRCNickname == "" {
+		return errors.New("'IRCNickname' is not defined")
+	}
+
+	if network.IRCServer == "" {
+		return errors.New("'IRCServer' is not defined")
+	}
+
+	if network.SASLPassword == "" {
+		network.SASLPassword = secrets.For(network.Name).SASLPassword
+	}
+
+	switch network.NickServRecoverCommand {
+	case "":
+		network.NickServRecoverCommand = NickServGhost
+	case NickServGhost, NickServRegain:
+	default:
+		return fmt.Errorf("'NickServRecoverCommand' is invalid: %s",
+			network.NickServRecoverCommand)
+	}
+
+	if network.NickRegainInterval == "" {
+		network.NickRegainInterval = "5m"
+	}
+
+	if _, err := time.ParseDuration(network.NickRegainInterval); err != nil {
+		return errors.New("'NickRegainInterval' is invalid: " +
+			err.Error())
+	}
+
+	switch network.Transport {
+	case "", TransportIRCEvent, TransportNative:
+	default:
+		return fmt.Errorf("'Transport' is invalid: %s", network.Transport)
+	}
+
+	if (network.TLSCertFile == "") != (network.TLSKeyFile == "") {
+		return errors.New("'TLSCertFile' and 'TLSKeyFile' go together")
+	}
+
+	switch network.SASLMechanism {
+	case "":
+	case SASLPlain:
+		if network.SASLLogin == "" || network.SASLPassword == "" {
+			return errors.New("'SASLLogin' and 'SASLPassword' are " +
+				"required by SASL PLAIN")
+		}
+	case SASLExternal:
+		if network.Transport != TransportNative {
+			return errors.New("SASL EXTERNAL requires the native " +
+				"'Transport'")
+		}
+		if !network.IRCUseTLS || network.TLSCertFile == "" {
+			return errors.New("'IRCUseTLS' and 'TLSCertFile' are " +
+				"required by SASL EXTERNAL")
+		}
+	default:
+		return fmt.Errorf("'SASLMechanism' is invalid: %s",
+			network.SASLMechanism)
+	}
+
+	if network.FloodBurst == 0 {
+		network.FloodBurst = 4
+	}
+
+	if network.FloodBurst < 1 {
+		return errors.New("'FloodBurst' must be at least 1")
+	}
+
+	if network.FloodInterval == "" {
+		network.FloodInterval = "1s"
+	}
+
+	if _, err := time.ParseDuration(network.FloodInterval); err != nil {
+		return errors.New("'FloodInterval' is invalid: " + err.Error())
+	}
+
+	switch network.Model {
+	case "":
+		network.Model = ModelShared
+	case ModelShared, ModelOwn:
+	default:
+		return fmt.Errorf("'Model' is invalid: %s", network.Model)
+	}
+
+	return network.setChannelModelDefaults()
+}
+
+// setChannelModelDefaults fills the unset channel model parameters and checks
+// that the blends only refer to existing models.
+func (network *NetworkCfg) setChannelModelDefaults() error {
+	for channel, model := range network.ChannelModels {
+		switch model.Model {
+		case "":
+			model.Model = ModelShared
+		case ModelShared, ModelOwn:
+		default:
+			return fmt.Errorf("'ChannelModels' of %s: 'Model' is "+
+				"invalid: %s", channel, model.Model)
+		}
+		network.ChannelModels[channel] = model
+	}
+
+	for channel, model := range network.ChannelModels {
+		for name, weight := range model.Blend {
+			if weight < 1 {
+				return fmt.Errorf("'ChannelModels' of %s: weight "+
+					"of %s must be at least 1", channel, name)
+			}
+			if name == ModelShared {
+				continue
+			}
+			if network.GetChannelModel(name).Model != ModelOwn {
+				return fmt.Errorf("'ChannelModels' of %s: %s has "+
+					"no model of its own", channel, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetChannelModel returns the model settings of a channel, channel names are
+// compared with the rfc1459 casemapping.
+func (network *NetworkCfg) GetChannelModel(channel string) ChannelModelCfg {
+	for name, model := range network.ChannelModels {
+		if ircEqual(name, channel) {
+			return model
+		}
+	}
+
+	return ChannelModelCfg{Model: ModelShared}
+}
+
 // Look in the current directory for an config.json file.
 func parseConfigFile() error {
 	file, err := os.Open(cmd.ConfigFile)
@@ -83,28 +425,96 @@ func parseConfigFile() error {
 		return err
 	}
 
-	if cfg.IRCNickname == "" {
-		return errors.New("'IRCNickname' is not defined")
+	if cfg.SecretsFilePath != "" {
+		if err := parseSecretsFile(cfg.SecretsFilePath); err != nil {
+			return errors.New("'SecretsFilePath' is invalid: " +
+				err.Error())
+		}
 	}
 
-	if cfg.IRCServer == "" {
-		return errors.New("'IRCServer' is not defined")
+	// Without Networks, the top-level settings define the only network.
+	if len(cfg.Networks) == 0 {
+		if cfg.NetworkCfg.Name == "" {
+			cfg.NetworkCfg.Name = "default"
+		}
+		cfg.Networks = []NetworkCfg{cfg.NetworkCfg}
+	} else if cfg.NetworkCfg.IRCServer != "" {
+		return errors.New("'IRCServer' and 'Networks' are exclusive")
+	}
+
+	names := make(StringSet)
+	for i := range cfg.Networks {
+		network := &cfg.Networks[i]
+		if network.Name == "" {
+			return fmt.Errorf("'Networks' entry %d has no 'Name'", i)
+		}
+		if names[network.Name] {
+			return fmt.Errorf("'Networks' has several '%s'",
+				network.Name)
+		}
+		names.Add(network.Name)
+
+		if err := network.setDefaults(); err != nil {
+			return fmt.Errorf("network '%s': %s", network.Name,
+				err.Error())
+		}
 	}
 
 	if cfg.MarkovDataPath == "" {
 		return errors.New("'MarkovDataPath' is not defined")
 	}
 
+	if cfg.MarkovOrder == 0 {
+		cfg.MarkovOrder = 2
+	}
+
+	if cfg.MarkovOrder < MinMarkovOrder || cfg.MarkovOrder > MaxMarkovOrder {
+		return fmt.Errorf("'MarkovOrder' must be between %d and %d",
+			MinMarkovOrder, MaxMarkovOrder)
+	}
+
+	if cfg.SnapshotPath == "" {
+		cfg.SnapshotPath = filepath.Join(cfg.MarkovDataPath, "chain.snapshot")
+	}
+
+	if cfg.OptOutFilePath == "" {
+		cfg.OptOutFilePath = filepath.Join(cfg.MarkovDataPath,
+			"optouts.json")
+	}
+
+	if err := parseOptOutFile(cfg.OptOutFilePath); err != nil {
+		return errors.New("'OptOutFilePath' is invalid: " + err.Error())
+	}
+
+	if cfg.SpeakerMinLines == 0 {
+		cfg.SpeakerMinLines = 100
+	}
+
+	if cfg.SnapshotInterval == "" {
+		cfg.SnapshotInterval = "10m"
+	}
+
+	if _, err := time.ParseDuration(cfg.SnapshotInterval); err != nil {
+		return errors.New("'SnapshotInterval' is invalid: " + err.Error())
+	}
+
 	return nil
 }
 
-// Parse the command line arguments and populate the global cmd struct.
-func parseCommandLine() {
+// Parse the command line arguments and populate the global cmd struct.  The
+// requested command is returned, if any.
+func parseCommandLine() string {
 	flagParser := flags.NewParser(&cmd, flags.PassDoubleDash)
+	flagParser.SubcommandsOptional = true
 	_, err := flagParser.Parse()
 	if err != nil {
 		println("command line error: " + err.Error())
 		flagParser.WriteHelp(os.Stderr)
 		os.Exit(1)
 	}
+
+	if flagParser.Active == nil {
+		return ""
+	}
+	return flagParser.Active.Name
 }
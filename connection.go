@@ -6,13 +6,14 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,130 +26,357 @@ const (
 
 // Connection error codes (RFC 1459)
 const (
-	ErrCodeNoNicknameGiven  = 431
-	ErrCodeErroneusNickname = 432
-	ErrCodeNicknameInUse    = 433
-	ErrCodeNickCollision    = 436
+	ErrCodeNoNicknameGiven  = "431"
+	ErrCodeErroneusNickname = "432"
+	ErrCodeNicknameInUse    = "433"
+	ErrCodeNickCollision    = "436"
 )
 
-var (
-	// ConnectionState is the current state of the connection state machine.
-	ConnectionState = ConnStateInit
+// ErrServerDisconnected is returned by Loop when the server closed the
+// connection.
+var ErrServerDisconnected = errors.New("server disconnected")
 
-	// reServerMessage is a regexp to parse IRC server messages.
-	reServerMessage = regexp.MustCompile(`^:[^ ]+ ([0-9]{2,4}) ([^ ]+) (.*)`)
-)
+// nativeTransport is the built-in IRC client.  A reader (Loop) parses the
+// lines received from the server and dispatches them, a writer goroutine sends
+// the lines queued on outgoing.
+type nativeTransport struct {
+	options  TransportOptions
+	handlers EventHandlers
+
+	// mutex protects the fields below, they change with the connection.
+	mutex    sync.Mutex
+	nick     string
+	hostmask string
+	state    int
+	conn     net.Conn
+	outgoing chan string
+	done     chan struct{}
+	quitting bool
+
+	// IRCv3 capabilities listed by the server and enabled, and the
+	// messages waiting for their echo (echo-message).
+	availableCaps StringSet
+	caps          StringSet
+	pendingEchoes []pendingEcho
+}
+
+func newNativeTransport(options TransportOptions, handlers EventHandlers) *nativeTransport {
+	return &nativeTransport{
+		options:  options,
+		nick:     options.Nick,
+		handlers: handlers,
+		state:    ConnStateInit,
+	}
+}
+
+// redactLine hides the passwords from the logs, in the commands sent to the
+// server and in their echo (after the tags and the source).
+func redactLine(line string) string {
+	cmd := line
+	for (strings.HasPrefix(cmd, "@") || strings.HasPrefix(cmd, ":")) &&
+		strings.Contains(cmd, " ") {
+		cmd = cmd[strings.Index(cmd, " ")+1:]
+	}
+	head := line[:len(line)-len(cmd)]
+
+	upper := strings.ToUpper(cmd)
+	switch {
+	case strings.HasPrefix(upper, "AUTHENTICATE ") &&
+		!strings.HasPrefix(upper, "AUTHENTICATE +") &&
+		upper != "AUTHENTICATE "+SASLPlain &&
+		upper != "AUTHENTICATE "+SASLExternal:
+		return head + "AUTHENTICATE <redacted>"
+	case strings.HasPrefix(upper, "PRIVMSG NICKSERV :"):
+		i := strings.Index(cmd, ":")
+		return head + cmd[:i+1] + redactPrivmsg(nickServ, cmd[i+1:])
+	}
+	return line
+}
+
+// redactPrivmsg hides the password of a message to NickServ, only the
+// command is kept.
+func redactPrivmsg(target, text string) string {
+	if !strings.EqualFold(target, nickServ) {
+		return text
+	}
+	if fields := strings.Fields(text); len(fields) > 1 {
+		return fields[0] + " <redacted>"
+	}
+	return text
+}
 
 // Send a command to the IRC server.
-func sendLine(conn net.Conn, cmd string) {
+func sendLine(conn net.Conn, cmd string) error {
 	cmd = strings.TrimSpace(cmd)
-	log.Printf("> %s", cmd)
-	fmt.Fprintf(conn, "%s\r\n", cmd)
+	log.Printf("> %s", redactLine(cmd))
+	_, err := fmt.Fprintf(conn, "%s\r\n", cmd)
+	return err
 }
 
-func parseServerMessageCode(line string) int16 {
-	tokens := reServerMessage.FindStringSubmatch(line)
-	if tokens == nil {
-		return 0
+// dial opens the connection to the server, over TLS if configured.
+func (t *nativeTransport) dial() (net.Conn, error) {
+	if t.options.TLSConfig != nil {
+		return tls.Dial("tcp", t.options.Server, t.options.TLSConfig)
 	}
+	return net.Dial("tcp", t.options.Server)
+}
 
-	code, err := strconv.ParseInt(tokens[1], 10, 16)
+// Connect to the selected server and register with the configured nick, every
+// new connection starts over with the configured nick.  The registration is
+// held by the capability negotiation (CAP LS) until the capabilities are
+// enabled and the SASL authentication is over.
+func (t *nativeTransport) Connect() error {
+	conn, err := t.dial()
 	if err != nil {
-		log.Printf("error: invalid server message: bad code (%s) in: %s",
-			err.Error(), line)
-		return 0
+		return err
 	}
 
-	if tokens[2] != cfg.IRCNickname {
-		log.Printf("error: invalid server message: wrong nickname in: %s",
-			line)
-		return 0
-	}
+	t.mutex.Lock()
+	t.conn = conn
+	t.outgoing = make(chan string, 64)
+	t.done = make(chan struct{})
+	t.state = ConnStateWaitingForHello
+	t.nick = t.options.Nick
+	t.hostmask = ""
+	t.availableCaps = make(StringSet)
+	t.caps = make(StringSet)
+	t.pendingEchoes = nil
+	nick := t.nick
+	t.mutex.Unlock()
+
+	go t.connectionWriter(conn, t.outgoing, t.done)
+
+	t.send("CAP LS 302")
+
+	t.send(fmt.Sprintf("NICK %s", nick))
+	t.send(fmt.Sprintf("USER %s localhost 127.0.0.1 :%s", nick, nick))
 
-	return int16(code)
+	return nil
 }
 
-// Connect to the selected server and join all the specified channels.
-func connect() (net.Conn, error) {
-	conn, err := net.Dial("tcp", cfg.IRCServer)
-	if err != nil {
-		return nil, err
+// send queues a line for the writer, it is dropped if the connection is over.
+func (t *nativeTransport) send(line string) {
+	t.mutex.Lock()
+	outgoing, done := t.outgoing, t.done
+	t.mutex.Unlock()
+
+	if outgoing == nil {
+		return
 	}
 
-	return conn, nil
+	select {
+	case outgoing <- line:
+	case <-done:
+	}
 }
 
-func connectionReader(conn net.Conn, incoming chan string, disconnect chan string) {
-	bufReader := bufio.NewReader(conn)
+func (t *nativeTransport) connectionWriter(conn net.Conn, outgoing chan string, done chan struct{}) {
+	for {
+		select {
+		case line := <-outgoing:
+			if err := sendLine(conn, line); err != nil {
+				log.Printf("write error: %s", err.Error())
+				conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
 
+// Loop reads and dispatches the server messages until the connection is over.
+// A connection closed after Quit is not an error.
+func (t *nativeTransport) Loop() error {
+	t.mutex.Lock()
+	conn, done := t.conn, t.done
+	t.mutex.Unlock()
+
+	if conn == nil {
+		return errors.New("not connected")
+	}
+
+	defer func() {
+		close(done)
+		conn.Close()
+		t.mutex.Lock()
+		t.state = ConnStateInit
+		t.mutex.Unlock()
+	}()
+
+	bufReader := bufio.NewReader(conn)
 	for {
 		data, err := bufReader.ReadString('\n')
-		if err == io.EOF {
-			disconnect <- "server disconnected"
-			break
-		}
 		if err != nil {
-			panic(err)
-		}
+			t.mutex.Lock()
+			quitting := t.quitting
+			t.mutex.Unlock()
 
-		data = strings.Trim(data, "\r\n")
-		log.Printf("< %s", data)
-
-		switch ConnectionState {
-		case ConnStateWaitingForHello:
-			// This is the NICK/USER phase, add more underscores to
-			// the nick, until we find one available. If we get any
-			// message other than a NICK error, we assume the
-			// server likes us, we move on to channel joining
-			// state.
-			code := parseServerMessageCode(data)
-			log.Printf("Server Message Code: %d", code)
-
-			switch code {
-			case ErrCodeNoNicknameGiven, ErrCodeErroneusNickname, ErrCodeNicknameInUse, ErrCodeNickCollision:
-				cfg.IRCNickname = cfg.IRCNickname + "_"
-				ConnectionState = ConnStateInit
-			case 1:
-				ConnectionState = ConnStateLive
-				incoming <- data
-			default:
+			switch {
+			case quitting:
+				return nil
+			case err == io.EOF:
+				return ErrServerDisconnected
 			}
+			return err
+		}
 
-		case ConnStateLive:
-			// Handle PING request from the server. Without these
-			// our bot would time out. Don't push that to the
-			// channel.
-			if strings.Index(data, "PING :") == 0 {
-				r := strings.Replace(data, "PING", "PONG", 1)
-				fmt.Fprintf(conn, "%s\r\n", r)
-				continue
-			}
+		data = strings.Trim(data, "\r\n")
+		log.Printf("< %s", redactLine(data))
 
-			incoming <- data
-		// Standby
-		default:
-			time.Sleep(20 * time.Millisecond)
+		msg, err := ParseMessage(data)
+		if err != nil {
+			log.Printf("invalid server message (%s): %s",
+				err.Error(), redactLine(data))
+			continue
 		}
+
+		t.handleMessage(msg)
 	}
 }
 
-func connectionWriter(conn net.Conn, outgoing chan string) {
-	for {
-		switch ConnectionState {
-		case ConnStateInit:
-			sendLine(conn, fmt.Sprintf("NICK %s", cfg.IRCNickname))
-			sendLine(conn, fmt.Sprintf("USER %s localhost "+
-				"127.0.0.1 :%s\r\n", cfg.IRCNickname,
-				cfg.IRCNickname))
-			ConnectionState = ConnStateWaitingForHello
-		case ConnStateLive:
-			for msg := range outgoing {
-				log.Printf("> %s", msg)
-				fmt.Fprintf(conn, "%s\r\n", msg)
+// handleMessage updates the connection state machine and dispatches the
+// events to the handlers.
+func (t *nativeTransport) handleMessage(msg *Message) {
+	switch msg.Command {
+	case "PING":
+		// Without these our bot would time out.
+		t.send("PONG :" + msg.Trailing())
+
+		t.mutex.Lock()
+		t.pruneEchoes(time.Now())
+		t.mutex.Unlock()
+
+	case ErrCodeNoNicknameGiven, ErrCodeErroneusNickname,
+		ErrCodeNicknameInUse, ErrCodeNickCollision:
+		// This is the NICK/USER phase, add more underscores to the
+		// nick, until we find one available.
+		t.mutex.Lock()
+		registering := t.state == ConnStateWaitingForHello
+		if registering {
+			t.nick = t.nick + "_"
+		}
+		nick := t.nick
+		t.mutex.Unlock()
+
+		if registering {
+			t.send(fmt.Sprintf("NICK %s", nick))
+		}
+
+	case "CAP":
+		t.handleCAP(msg)
+
+	case "AUTHENTICATE", RplSASLSuccess, ErrCodeNickLocked,
+		ErrCodeSASLFail, ErrCodeSASLTooLong, ErrCodeSASLAborted,
+		ErrCodeSASLAlready, RplSASLMechs:
+		t.handleSASL(msg)
+
+	case "001":
+		// Any welcome means the server likes our nick.
+		t.mutex.Lock()
+		t.state = ConnStateLive
+		if nick := msg.Param(0); nick != "" {
+			t.nick = nick
+		}
+		t.mutex.Unlock()
+
+		if t.handlers.Welcome != nil {
+			t.handlers.Welcome()
+		}
+
+	case "NICK":
+		t.mutex.Lock()
+		own := ircEqual(msg.Nick, t.nick)
+		if own {
+			t.nick = msg.Param(0)
+			t.hostmask = ""
+		}
+		t.mutex.Unlock()
+
+		if own && t.handlers.NickChanged != nil {
+			t.handlers.NickChanged(msg.Param(0))
+		}
+
+	case "JOIN", "PART":
+		if !ircEqual(msg.Nick, t.Nick()) {
+			return
+		}
+
+		// Our JOIN tells us how the others see us.
+		if msg.Command == "JOIN" && msg.Host != "" {
+			t.mutex.Lock()
+			t.hostmask = msg.Prefix
+			t.mutex.Unlock()
+		}
+
+		handler := t.handlers.Joined
+		if msg.Command == "PART" {
+			handler = t.handlers.Parted
+		}
+		if handler != nil {
+			handler(msg.Param(0))
+		}
+
+	case "KICK":
+		if ircEqual(msg.Param(1), t.Nick()) && t.handlers.Parted != nil {
+			t.handlers.Parted(msg.Param(0))
+		}
+
+	case "PRIVMSG":
+		target, body := msg.Param(0), msg.Trailing()
+		if len(msg.Params) < 2 {
+			return
+		}
+
+		// Our own messages only come back with echo-message, the
+		// ones to the services are not tracked.
+		if ircEqual(msg.Nick, t.Nick()) {
+			if !strings.EqualFold(target, nickServ) {
+				t.confirmEcho(target, body)
+			}
+			return
+		}
+
+		command, argument, isCTCP := parseCTCP(body)
+		switch {
+		case !isCTCP:
+			if t.handlers.Message != nil {
+				t.handlers.Message(msg.Speaker(), target, body,
+					msg.Time())
+			}
+		case command == "ACTION":
+			if t.handlers.Action != nil {
+				t.handlers.Action(msg.Speaker(), target, argument,
+					msg.Time())
 			}
-		// Standby
-		default:
-			time.Sleep(20 * time.Millisecond)
 		}
 	}
 }
+
+// Nick returns the current nick of the bot.
+func (t *nativeTransport) Nick() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.nick
+}
+
+// Hostmask returns our nick!user@host, learned from our last JOIN.
+func (t *nativeTransport) Hostmask() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.hostmask
+}
+
+// SetNick asks the server to change our nick.
+func (t *nativeTransport) SetNick(nick string) {
+	t.send("NICK " + nick)
+}
+
+// Quit asks the server to close the connection.
+func (t *nativeTransport) Quit() {
+	t.mutex.Lock()
+	t.quitting = true
+	t.mutex.Unlock()
+
+	t.send("QUIT :bye")
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startNativeBot starts a bot with an empty chain, connected through the
+// native transport to a fake server.
+func startNativeBot(t *testing.T, channels ...string) (*Network, *fakeServer) {
+	server := newFakeServer(t)
+	network := connectNativeBot(t, server, TransportOptions{
+		Server: server.Addr(),
+		Nick:   "paglop",
+	}, channels...)
+
+	return network, server
+}
+
+// newNativeNetwork returns a network with an empty chain and a native
+// transport, without any throttling.
+func newNativeNetwork(t *testing.T, options TransportOptions, channels ...string) *Network {
+	network, _ := setupTestBot(t)
+	cfg.TestMode = false
+	network.config.Channels = channels
+	network.config.FloodBurst = 100
+	network.config.FloodInterval = "1ms"
+	network.models.shared.Chain = NewChainWithSource(2, rand.NewSource(1))
+	network.setTransport(newNativeTransport(options, network.handlers()))
+
+	return network
+}
+
+// connectNativeBot starts a bot with an empty chain and connects it to server
+// with the given options.
+func connectNativeBot(t *testing.T, server *fakeServer, options TransportOptions, channels ...string) *Network {
+	network := newNativeNetwork(t, options, channels...)
+	go network.sendQueue.Run()
+
+	if err := network.transport.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	server.Accept()
+
+	loopDone := make(chan error, 1)
+	go func() {
+		loopDone <- network.transport.Loop()
+	}()
+
+	t.Cleanup(func() {
+		network.sendQueue.Close()
+		server.Close()
+		select {
+		case <-loopDone:
+		case <-time.After(fakeServerTimeout):
+			t.Error("transport loop did not return")
+		}
+	})
+
+	return network
+}
+
+func TestNativeRegistrationAndAutojoin(t *testing.T) {
+	network, server := startNativeBot(t, "#debsquad")
+
+	server.Register("paglop")
+	server.Expect("JOIN #debsquad")
+
+	if nick := network.transport.Nick(); nick != "paglop" {
+		t.Fatalf("wrong nick: %s", nick)
+	}
+}
+
+func TestNativePingPong(t *testing.T) {
+	_, server := startNativeBot(t)
+
+	server.Register("paglop")
+	server.Send("PING :irc.example.org")
+	server.Expect("PONG :irc.example.org")
+}
+
+func TestNativeNickInUse(t *testing.T) {
+	network, server := startNativeBot(t, "#debsquad")
+
+	server.Expect("CAP LS 302")
+	server.Expect("NICK paglop")
+	server.Expect("USER paglop localhost 127.0.0.1 :paglop")
+	server.Send(":irc.example.org 433 * paglop :Nickname is already in use")
+	server.Expect("NICK paglop_")
+	server.Send(":irc.example.org 433 * paglop_ :Nickname is already in use")
+	server.Expect("NICK paglop__")
+	server.Send(":irc.example.org 001 paglop__ :Welcome")
+	server.Expect("NICK paglop")
+	server.Expect("JOIN #debsquad")
+
+	if nick := network.transport.Nick(); nick != "paglop__" {
+		t.Fatalf("wrong nick: %s", nick)
+	}
+
+	// Only a failed registration leads to a new nick.
+	server.Send(":irc.example.org 433 paglop__ paglop :Nickname is already in use")
+	server.Sync()
+	if nick := network.transport.Nick(); nick != "paglop__" {
+		t.Fatalf("nick changed after registration: %s", nick)
+	}
+}
+
+func TestNativeLearnAndReply(t *testing.T) {
+	network, server := startNativeBot(t, "#debsquad")
+	server.Register("paglop")
+	server.Expect("JOIN #debsquad")
+
+	// Regular chatter is learned silently.
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :le chat dort sur le tapis")
+	server.Sync()
+	if network.models.shared.Chain.GetScoredWords("tapis")[0].Score != 1 {
+		t.Fatal("line not learned")
+	}
+
+	// Addressed lines are answered but not learned.
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :paglop: tapis")
+	server.Expect("PRIVMSG #debsquad :le chat dort sur le tapis")
+	if network.models.shared.Chain.GetScoredWords("tapis")[0].Score != 1 {
+		t.Fatal("addressed line learned")
+	}
+
+	// Private messages are answered to their author.
+	server.Send(":bob!~bob@example.org PRIVMSG paglop :tapis")
+	server.Expect("PRIVMSG bob :le chat dort sur le tapis")
+}
+
+func TestNativeActionRoundTrip(t *testing.T) {
+	_, server := startNativeBot(t, "#debsquad")
+	server.Register("paglop")
+	server.Expect("JOIN #debsquad")
+
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :\x01ACTION caresse le chat\x01")
+	server.Sync()
+
+	server.Send(":alice!~alice@example.org PRIVMSG #debsquad :paglop, caresse")
+	server.Expect("PRIVMSG #debsquad :\x01ACTION caresse le chat\x01")
+}
+
+func TestNativeIgnoresOtherCTCP(t *testing.T) {
+	network, server := startNativeBot(t, "#debsquad")
+	server.Register("paglop")
+	server.Expect("JOIN #debsquad")
+
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :\x01VERSION\x01")
+	server.Sync()
+
+	if network.models.shared.Chain.GetScoredWords("VERSION")[0].Score != 0 {
+		t.Fatal("CTCP learned")
+	}
+}
+
+func TestNativeReconnect(t *testing.T) {
+	server := newFakeServer(t)
+	network := newNativeNetwork(t, TransportOptions{
+		Server: server.Addr(),
+		Nick:   "paglop",
+	}, "#debsquad")
+	network.supervisor.minDelay = time.Millisecond
+	network.supervisor.maxDelay = 10 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		network.Run()
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		network.transport.Quit()
+		server.Expect("QUIT :bye")
+		server.Close()
+		select {
+		case <-done:
+		case <-time.After(fakeServerTimeout):
+			t.Error("network did not stop after quit")
+		}
+	})
+
+	server.Accept()
+	server.Register("paglop")
+	server.Expect("JOIN #debsquad")
+	server.Send(":PagLop!~paglop@example.org JOIN #DebSquad")
+
+	// Channels joined at runtime are remembered too, until we leave, whatever
+	// the casing used by the server.
+	server.Send(":paglop!~paglop@example.org JOIN #runtime")
+	server.Send(":paglop!~paglop@example.org JOIN #gone")
+	server.Send(":paglop!~paglop@example.org PART #Gone")
+	server.Send(":paglop!~paglop@example.org JOIN #kicked")
+	server.Send(":op!~op@example.org KICK #KICKED PAGLOP :out")
+	server.Sync()
+
+	server.Disconnect()
+	server.Accept()
+	server.Register("paglop")
+	server.Expect("JOIN #debsquad")
+	server.Expect("JOIN #runtime")
+
+	if _, err := os.Stat(network.models.shared.SnapshotPath); err != nil {
+		t.Fatalf("no snapshot saved before reconnecting: %s", err)
+	}
+
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :paglop: status")
+	status := server.ReadLine()
+	if !strings.Contains(status, "1 reconnect(s), last one ") ||
+		strings.Contains(status, ErrServerDisconnected.Error()) {
+		t.Fatalf("wrong status: %q", status)
+	}
+}
+
+func TestNativeCapabilities(t *testing.T) {
+	network, server := startNativeBot(t)
+
+	// The server lists its capabilities over several lines.
+	server.Expect("CAP LS 302")
+	server.Expect("NICK paglop")
+	server.Expect("USER paglop localhost 127.0.0.1 :paglop")
+	server.Send(":irc.example.org CAP * LS * :multi-prefix server-time echo-message")
+	server.Send(":irc.example.org CAP * LS :account-tag sasl=PLAIN")
+	server.Expect("CAP REQ :server-time account-tag echo-message")
+	server.Send(":irc.example.org CAP paglop ACK :server-time account-tag echo-message")
+	server.Expect("CAP END")
+	server.Send(":irc.example.org 001 paglop :Welcome")
+	server.Sync()
+
+	for _, c := range []string{"server-time", "account-tag", "echo-message"} {
+		if !network.transport.(*nativeTransport).hasCap(c) {
+			t.Fatalf("%s not enabled", c)
+		}
+	}
+	if network.transport.(*nativeTransport).hasCap("multi-prefix") {
+		t.Fatal("multi-prefix enabled without being requested")
+	}
+}
+
+func TestNativeServerTimeAndAccount(t *testing.T) {
+	network, server := startNativeBot(t, "#debsquad")
+	server.Register("paglop", "server-time", "account-tag")
+	server.Expect("JOIN #debsquad")
+	network.config.Ignore = []string{"account:alfred"}
+
+	var received []time.Time
+	network.transport.(*nativeTransport).handlers.Message = func(speaker Speaker, target, body string, at time.Time) {
+		received = append(received, at)
+		network.MessageHandler(speaker, target, body, at)
+	}
+
+	server.Send("@time=2015-02-03T04:05:06.000Z;account=alfred :robot!~r@example.org PRIVMSG #debsquad :le chat dort sur le tapis")
+	server.Send("@time=2015-02-03T04:05:07.000Z;account=bob :bob!~bob@example.org PRIVMSG #debsquad :le chat dort sur le lit")
+	server.Sync()
+
+	if len(received) != 2 || !received[0].Equal(time.Date(2015, 2, 3, 4, 5, 6, 0, time.UTC)) {
+		t.Fatalf("wrong server times: %v", received)
+	}
+	if network.models.shared.Chain.GetScoredWords("tapis")[0].Score != 0 {
+		t.Fatal("ignored account learned")
+	}
+	if network.models.shared.Chain.GetScoredWords("lit")[0].Score != 1 {
+		t.Fatal("line not learned")
+	}
+}
+
+func TestNativeEchoMessage(t *testing.T) {
+	network, server := startNativeBot(t, "#debsquad")
+	server.Register("paglop", "echo-message")
+	server.Expect("JOIN #debsquad")
+
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :le chat dort sur le tapis")
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :paglop: tapis")
+	server.Expect("PRIVMSG #debsquad :le chat dort sur le tapis")
+	server.Sync()
+	if n := network.transport.(*nativeTransport).undelivered(); n != 1 {
+		t.Fatalf("wrong number of undelivered messages: %d", n)
+	}
+
+	// The echo confirms the delivery and is not learned.
+	server.Send(":paglop!~paglop@example.org PRIVMSG #DebSquad :le chat dort sur le tapis")
+	server.Sync()
+	if n := network.transport.(*nativeTransport).undelivered(); n != 0 {
+		t.Fatalf("echo did not confirm the delivery: %d", n)
+	}
+	if network.models.shared.Chain.GetScoredWords("tapis")[0].Score != 1 {
+		t.Fatal("echo learned")
+	}
+}
+
+func TestNativeEchoMessageLost(t *testing.T) {
+	network, server := startNativeBot(t, "#debsquad")
+	server.Register("paglop", "echo-message")
+	server.Expect("JOIN #debsquad")
+
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :le chat dort sur le tapis")
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :paglop: tapis")
+	server.Expect("PRIVMSG #debsquad :le chat dort sur le tapis")
+	server.Sync()
+
+	transport := network.transport.(*nativeTransport)
+	transport.mutex.Lock()
+	transport.pendingEchoes[0].sent = time.Now().Add(-2 * echoTimeout)
+	transport.mutex.Unlock()
+
+	// No echo ever comes, the next PING reports the loss.
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	server.Sync()
+	log.SetOutput(ioutil.Discard)
+
+	if n := transport.undelivered(); n != 0 {
+		t.Fatalf("lost message still waiting for its echo: %d", n)
+	}
+	if !strings.Contains(output.String(), "message to #debsquad not delivered") {
+		t.Fatalf("lost message not reported: %q", output.String())
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+// WordID is the interned identifier of a word in a Dictionary.
+type WordID uint32
+
+// Reserved word identifiers.  NoWord is never recorded in the chain, it is
+// used for words unknown to the dictionary and for the unused slots of a
+// Tuple.
+const (
+	NoWord      WordID = 0
+	LineStartID WordID = 1
+	LineEndID   WordID = 2
+)
+
+// Dictionary interns words to integer identifiers and keeps track of the
+// number of times each word was seen.
+type Dictionary struct {
+	Words  []string
+	Counts []uint64
+
+	ids map[string]WordID
+}
+
+// NewDictionary returns a Dictionary containing only the reserved words.
+func NewDictionary() *Dictionary {
+	dict := &Dictionary{ids: make(map[string]WordID)}
+	for _, word := range []string{"", LineStart, LineEnd} {
+		dict.Intern(word)
+	}
+	return dict
+}
+
+// rebuildIndex recreates the word to identifier map, e.g. after the words
+// were restored from a snapshot.
+func (dict *Dictionary) rebuildIndex() {
+	dict.ids = make(map[string]WordID, len(dict.Words))
+	for id, word := range dict.Words {
+		dict.ids[word] = WordID(id)
+	}
+}
+
+// Intern returns the identifier of word, registering it if needed.
+func (dict *Dictionary) Intern(word string) WordID {
+	if id, ok := dict.ids[word]; ok {
+		return id
+	}
+
+	id := WordID(len(dict.Words))
+	dict.Words = append(dict.Words, word)
+	dict.Counts = append(dict.Counts, 0)
+	dict.ids[word] = id
+
+	return id
+}
+
+// Lookup returns the identifier of word or NoWord if it was never seen.
+func (dict *Dictionary) Lookup(word string) WordID {
+	return dict.ids[word]
+}
+
+// Word returns the word behind the given identifier.
+func (dict *Dictionary) Word(id WordID) string {
+	return dict.Words[id]
+}
+
+// Count returns the number of times word was seen.
+func (dict *Dictionary) Count(word string) uint64 {
+	return dict.Counts[dict.Lookup(word)]
+}
+
+// IsSentinelID returns true if the given identifier marks the beginning or the
+// end of a line.
+func IsSentinelID(id WordID) bool {
+	return id == LineStartID || id == LineEndID
+}
+
+// Tuple is a fixed-size leader of interned words, only the first leaderLen
+// slots are used, the others are left to NoWord.
+type Tuple [MaxMarkovOrder]WordID
+
+// Shift removes the first word of the first n slots and appends id.
+func (t *Tuple) Shift(n int, id WordID) {
+	copy(t[:n-1], t[1:n])
+	t[n-1] = id
+}
+
+// Unshift removes the last word of the first n slots and puts id first.
+func (t *Tuple) Unshift(n int, id WordID) {
+	copy(t[1:n], t[:n-1])
+	t[0] = id
+}
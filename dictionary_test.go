@@ -0,0 +1,39 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestDictionaryReservedWords(t *testing.T) {
+	dict := NewDictionary()
+
+	if dict.Lookup(LineStart) != LineStartID || dict.Lookup(LineEnd) != LineEndID {
+		t.Fatal("sentinels not interned to their reserved IDs")
+	}
+
+	if dict.Lookup("unknown") != NoWord {
+		t.Fatal("unknown word not mapped to NoWord")
+	}
+
+	id := dict.Intern("hello")
+	if id <= LineEndID || dict.Intern("hello") != id || dict.Word(id) != "hello" {
+		t.Fatalf("wrong interning of hello: %d", id)
+	}
+}
+
+func TestTupleShiftUnshift(t *testing.T) {
+	tuple := Tuple{1, 2, 3}
+
+	tuple.Shift(3, 9)
+	if tuple != (Tuple{2, 3, 9}) {
+		t.Fatalf("not shifted: %v", tuple)
+	}
+
+	tuple.Unshift(3, 7)
+	if tuple != (Tuple{7, 2, 3}) {
+		t.Fatalf("not unshifted: %v", tuple)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+)
+
+// Follower is a word following a leader along with the number of times it was
+// seen there.
+type Follower struct {
+	Word  WordID
+	Count uint32
+}
+
+// Followers is the counted list of words following a leader.  Each distinct
+// follower is stored once, the list is kept sorted by word ID so lookups stay
+// fast on very popular leaders (e.g. the beginning of lines) and picking is
+// deterministic.
+type Followers []Follower
+
+// find returns the position of word in the list, or the position where it
+// should be inserted.
+func (f Followers) find(word WordID) int {
+	return sort.Search(len(f), func(i int) bool {
+		return f[i].Word >= word
+	})
+}
+
+// Add records one more occurrence of word.
+func (f *Followers) Add(word WordID) {
+	list := *f
+	i := list.find(word)
+	if i < len(list) && list[i].Word == word {
+		list[i].Count++
+		return
+	}
+
+	list = append(list, Follower{})
+	copy(list[i+1:], list[i:])
+	list[i] = Follower{word, 1}
+	*f = list
+}
+
+// Remove forgets one occurrence of word, the follower is dropped once it was
+// never seen.
+func (f *Followers) Remove(word WordID) {
+	list := *f
+	i := list.find(word)
+	if i == len(list) || list[i].Word != word {
+		return
+	}
+
+	if list[i].Count > 1 {
+		list[i].Count--
+		return
+	}
+
+	*f = append(list[:i], list[i+1:]...)
+}
+
+// Count returns the number of occurrences of word.
+func (f Followers) Count(word WordID) uint32 {
+	i := f.find(word)
+	if i == len(f) || f[i].Word != word {
+		return 0
+	}
+	return f[i].Count
+}
+
+// Total returns the number of occurrences of all the followers.
+func (f Followers) Total() uint64 {
+	var total uint64
+	for _, follower := range f {
+		total += uint64(follower.Count)
+	}
+	return total
+}
+
+// Pick returns the follower found at position r (0 <= r < Total) when all the
+// occurrences are laid out in order.  Passing a uniformly random r selects a
+// follower with a probability proportional to its count.
+func (f Followers) Pick(r uint64) WordID {
+	for _, follower := range f {
+		if r < uint64(follower.Count) {
+			return follower.Word
+		}
+		r -= uint64(follower.Count)
+	}
+
+	return f[len(f)-1].Word
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFollowersPickIsProportional(t *testing.T) {
+	f := &Followers{}
+	for _, word := range []WordID{10, 11, 10, 12, 10, 11} {
+		f.Add(word)
+	}
+
+	if len(*f) != 3 || f.Total() != 6 {
+		t.Fatalf("wrong size: len=%d total=%d", len(*f), f.Total())
+	}
+
+	picked := make(map[WordID]int)
+	for r := uint64(0); r < f.Total(); r++ {
+		picked[f.Pick(r)]++
+	}
+
+	if picked[10] != 3 || picked[11] != 2 || picked[12] != 1 {
+		t.Fatalf("wrong distribution: %v", picked)
+	}
+}
+
+func TestFollowersSorted(t *testing.T) {
+	f := &Followers{}
+	for _, word := range []WordID{12, 10, 11, 12, 10, 12} {
+		f.Add(word)
+	}
+
+	expected := Followers{{10, 2}, {11, 1}, {12, 3}}
+	if !reflect.DeepEqual(*f, expected) {
+		t.Fatalf("wrong followers: %v", *f)
+	}
+}
+
+func TestFollowersRemove(t *testing.T) {
+	f := &Followers{{10, 2}, {11, 1}, {12, 3}}
+	for _, word := range []WordID{10, 11, 13, 12} {
+		f.Remove(word)
+	}
+
+	expected := Followers{{10, 1}, {12, 2}}
+	if !reflect.DeepEqual(*f, expected) {
+		t.Fatalf("wrong followers: %v", *f)
+	}
+}
+
+// sliceChain is the former layout of the chain tables, where every occurrence
+// of a follower is appended to the list of its leader.  It is only kept
+// around to compare against in benchmarks.
+type sliceChain struct {
+	forward   map[string][]string
+	backward  map[string][]string
+	words     map[string]uint64
+	leaderLen int
+}
+
+func newSliceChain(leaderLen int) *sliceChain {
+	return &sliceChain{
+		forward:   make(map[string][]string),
+		backward:  make(map[string][]string),
+		words:     make(map[string]uint64),
+		leaderLen: leaderLen,
+	}
+}
+
+func (chain *sliceChain) AddLine(line string) {
+	n := chain.leaderLen
+	window := make(Leader, n+1)
+	for i := range window {
+		window[i] = LineStart
+	}
+
+	words := append(strings.Fields(line), LineEnd)
+	for _, word := range words {
+		chain.words[word]++
+		window.Shift(word)
+		fKey := window[:n].String()
+		bKey := window[1:].String()
+		chain.forward[fKey] = append(chain.forward[fKey], window[n])
+		chain.backward[bKey] = append(chain.backward[bKey], window[0])
+	}
+}
+
+func (chain *sliceChain) Generate(n int) int {
+	p := make(Leader, chain.leaderLen)
+	for i := range p {
+		p[i] = LineStart
+	}
+
+	count := 0
+	for ; count < n; count++ {
+		choices := chain.forward[p.String()]
+		if len(choices) == 0 {
+			break
+		}
+		next := choices[rand.Intn(len(choices))]
+		if next == LineEnd {
+			break
+		}
+		p.Shift(next)
+	}
+
+	return count
+}
+
+var (
+	benchCorpusOnce  sync.Once
+	benchCorpusLines []string
+)
+
+// benchCorpus returns a synthetic corpus with a Zipf-like word distribution,
+// large enough for popular phrases to repeat many times.  It is only built
+// on the first call so plain test runs do not pay for it.
+func benchCorpus() []string {
+	benchCorpusOnce.Do(func() {
+		r := rand.New(rand.NewSource(1))
+		zipf := rand.NewZipf(r, 1.2, 1, 5000)
+
+		benchCorpusLines = make([]string, 50000)
+		for i := range benchCorpusLines {
+			words := make([]string, 5+r.Intn(10))
+			for j := range words {
+				words[j] = fmt.Sprintf("w%d", zipf.Uint64())
+			}
+			benchCorpusLines[i] = strings.Join(words, " ")
+		}
+	})
+
+	return benchCorpusLines
+}
+
+// heapInUse returns the number of bytes currently allocated on the heap after
+// a garbage collection.  It is signed since the heap may shrink between two
+// calls.
+func heapInUse() int64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
+
+func BenchmarkBuildCounted(b *testing.B) {
+	corpus := benchCorpus()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		before := heapInUse()
+		chain := NewChain(2)
+		for _, line := range corpus {
+			chain.AddLine(line)
+		}
+		b.ReportMetric(float64(heapInUse()-before), "heap-B")
+		runtime.KeepAlive(chain)
+	}
+}
+
+func BenchmarkBuildSlices(b *testing.B) {
+	corpus := benchCorpus()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		before := heapInUse()
+		chain := newSliceChain(2)
+		for _, line := range corpus {
+			chain.AddLine(line)
+		}
+		b.ReportMetric(float64(heapInUse()-before), "heap-B")
+		runtime.KeepAlive(chain)
+	}
+}
+
+func BenchmarkGenerateCounted(b *testing.B) {
+	chain := NewChain(2)
+	for _, line := range benchCorpus() {
+		chain.AddLine(line)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chain.GenerateCore(true, "", 20)
+	}
+}
+
+func BenchmarkGenerateSlices(b *testing.B) {
+	chain := newSliceChain(2)
+	for _, line := range benchCorpus() {
+		chain.AddLine(line)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chain.Generate(20)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reply loop detection: a speaker answering the bot within replyLoopWindow of
+// its last reply replyLoopThreshold times in a row is most likely another bot.
+// The bot then stops answering them for a back-off period, doubled every time
+// the loop resumes, up to replyLoopMaxBackoff.
+const (
+	replyLoopWindow     = 5 * time.Second
+	replyLoopThreshold  = 3
+	replyLoopMinBackoff = time.Minute
+	replyLoopMaxBackoff = time.Hour
+)
+
+// Speaker identifies the author of a message.  Account is only known if the
+// server reports it (e.g. IRCv3 account-tag).
+type Speaker struct {
+	Nick    string
+	User    string
+	Host    string
+	Account string
+}
+
+// Hostmask returns the nick!user@host form of the speaker.
+func (speaker Speaker) Hostmask() string {
+	return speaker.Nick + "!" + speaker.User + "@" + speaker.Host
+}
+
+// isIgnored returns true if the speaker matches any of the ignore entries.
+// Entries can be:
+//
+//	alfred               a nick (globs allowed, e.g. "*bot")
+//	*!*@bots.example.org a hostmask glob
+//	account:alfred       a services account name
+//
+// All comparisons are case-insensitive.
+func isIgnored(ignore []string, speaker Speaker) bool {
+	for _, entry := range ignore {
+		switch {
+		case strings.HasPrefix(entry, "account:"):
+			account := strings.TrimPrefix(entry, "account:")
+			if speaker.Account != "" && strings.EqualFold(account, speaker.Account) {
+				return true
+			}
+		case strings.ContainsAny(entry, "!@"):
+			if matchGlob(entry, speaker.Hostmask()) {
+				return true
+			}
+		default:
+			if matchGlob(entry, speaker.Nick) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchGlob matches s against an IRC style pattern where '*' matches any
+// sequence of characters and '?' matches a single character.  Unlike
+// path.Match, brackets are regular characters since they are common in nicks.
+func matchGlob(pattern, s string) bool {
+	p := []rune(strings.ToLower(pattern))
+	r := []rune(strings.ToLower(s))
+
+	// Iterative matching with backtracking on the last star.
+	pi, ri := 0, 0
+	star, mark := -1, 0
+	for ri < len(r) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == r[ri]):
+			pi++
+			ri++
+		case pi < len(p) && p[pi] == '*':
+			star = pi
+			mark = ri
+			pi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			ri = mark
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+
+	return pi == len(p)
+}
+
+// loopState is the reply loop state of a speaker in a channel.
+type loopState struct {
+	streak  int
+	backoff time.Duration
+	until   time.Time
+	seen    time.Time
+}
+
+// stale returns true once the state can be forgotten: the speaker has not
+// addressed the bot within the detection window and any back-off period is
+// long over, so its doubling would not matter anymore.
+func (state *loopState) stale(now time.Time) bool {
+	return now.Sub(state.seen) >= replyLoopWindow &&
+		now.Sub(state.until) >= replyLoopMaxBackoff
+}
+
+// loopDetector keeps track of how fast each speaker answers the bot.
+type loopDetector struct {
+	mutex sync.Mutex
+
+	// lastReply is when and to whom the bot last replied, per target.
+	lastReply   map[string]time.Time
+	lastReplyTo map[string]string
+
+	states map[string]*loopState
+
+	// pruned is when stale entries were last removed.
+	pruned time.Time
+}
+
+func newLoopDetector() *loopDetector {
+	return &loopDetector{
+		lastReply:   make(map[string]time.Time),
+		lastReplyTo: make(map[string]string),
+		states:      make(map[string]*loopState),
+	}
+}
+
+// Allow is called when nick addresses the bot on target, it returns false if
+// the bot should not answer because nick seems to be stuck in a reply loop
+// with the bot.
+func (ld *loopDetector) Allow(target, nick string, now time.Time) bool {
+	ld.mutex.Lock()
+	defer ld.mutex.Unlock()
+
+	ld.prune(now)
+
+	key := target + " " + strings.ToLower(nick)
+	state := ld.states[key]
+	if state == nil {
+		state = &loopState{}
+		ld.states[key] = state
+	}
+	state.seen = now
+
+	if now.Before(state.until) {
+		return false
+	}
+
+	quick := strings.EqualFold(ld.lastReplyTo[target], nick) &&
+		now.Sub(ld.lastReply[target]) < replyLoopWindow
+	if !quick {
+		state.streak = 0
+		return true
+	}
+
+	state.streak++
+	if state.streak < replyLoopThreshold {
+		return true
+	}
+
+	if state.backoff == 0 {
+		state.backoff = replyLoopMinBackoff
+	} else if state.backoff < replyLoopMaxBackoff {
+		state.backoff *= 2
+		if state.backoff > replyLoopMaxBackoff {
+			state.backoff = replyLoopMaxBackoff
+		}
+	}
+	state.streak = 0
+	state.until = now.Add(state.backoff)
+
+	return false
+}
+
+// Replied records that the bot answered nick on target.
+func (ld *loopDetector) Replied(target, nick string, now time.Time) {
+	ld.mutex.Lock()
+	defer ld.mutex.Unlock()
+
+	ld.prune(now)
+
+	ld.lastReply[target] = now
+	ld.lastReplyTo[target] = nick
+}
+
+// prune removes the replies and speaker states too old to matter, so the
+// detector does not grow with every speaker and target it ever saw.  It scans
+// at most once per detection window.
+func (ld *loopDetector) prune(now time.Time) {
+	if now.Sub(ld.pruned) < replyLoopWindow {
+		return
+	}
+	ld.pruned = now
+
+	for target, last := range ld.lastReply {
+		if now.Sub(last) >= replyLoopWindow {
+			delete(ld.lastReply, target)
+			delete(ld.lastReplyTo, target)
+		}
+	}
+
+	for key, state := range ld.states {
+		if state.stale(now) {
+			delete(ld.states, key)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIsIgnored(t *testing.T) {
+	ignore := []string{"alfred", "*bot", "*!*@bots.example.org",
+		"account:jeeves"}
+
+	tests := []struct {
+		speaker Speaker
+		ignored bool
+	}{
+		{Speaker{Nick: "alfred"}, true},
+		{Speaker{Nick: "Alfred"}, true},
+		{Speaker{Nick: "alfredo"}, false},
+		{Speaker{Nick: "buildbot"}, true},
+		{Speaker{Nick: "bob", User: "x", Host: "bots.example.org"}, true},
+		{Speaker{Nick: "bob", User: "x", Host: "example.org"}, false},
+		{Speaker{Nick: "bob", Account: "Jeeves"}, true},
+		{Speaker{Nick: "jeeves"}, false},
+		{Speaker{Nick: "nick[away]"}, false},
+	}
+
+	for _, test := range tests {
+		if isIgnored(ignore, test.speaker) != test.ignored {
+			t.Errorf("%+v: expected ignored=%v", test.speaker,
+				test.ignored)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"nick[away]", "NICK[away]", true},
+		{"*!*@*.example.org", "bob!~b@host.example.org", true},
+		{"*!*@*.example.org", "bob!~b@example.org", false},
+	}
+
+	for _, test := range tests {
+		if matchGlob(test.pattern, test.s) != test.match {
+			t.Errorf("matchGlob(%q, %q) != %v", test.pattern, test.s,
+				test.match)
+		}
+	}
+}
+
+func TestLoopDetectorBacksOff(t *testing.T) {
+	ld := newLoopDetector()
+	now := time.Now()
+
+	// A human answering slowly is never throttled.
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Minute)
+		if !ld.Allow("#chan", "bob", now) {
+			t.Fatal("slow speaker throttled")
+		}
+		ld.Replied("#chan", "bob", now)
+	}
+
+	// A bot answering right away is throttled after a few rounds.
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		if !ld.Allow("#chan", "alfred", now) {
+			break
+		}
+		ld.Replied("#chan", "alfred", now)
+		allowed++
+	}
+	if allowed != replyLoopThreshold {
+		t.Fatalf("loop detected after %d replies", allowed)
+	}
+
+	// Still backing off a bit later, but not for other speakers.
+	now = now.Add(replyLoopMinBackoff / 2)
+	if ld.Allow("#chan", "alfred", now) {
+		t.Fatal("back-off period not honored")
+	}
+	if !ld.Allow("#chan", "bob", now) {
+		t.Fatal("other speaker throttled")
+	}
+
+	// Back to normal after the back-off period.
+	now = now.Add(replyLoopMinBackoff)
+	if !ld.Allow("#chan", "alfred", now) {
+		t.Fatal("still throttled after the back-off period")
+	}
+}
+
+func TestLoopDetectorPrunes(t *testing.T) {
+	ld := newLoopDetector()
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		nick := fmt.Sprintf("bob%d", i)
+		ld.Allow("#chan", nick, now)
+		ld.Replied(nick, nick, now)
+	}
+
+	// A bot stuck in a loop is remembered through its back-off period.
+	for i := 0; i <= replyLoopThreshold; i++ {
+		now = now.Add(time.Second)
+		ld.Allow("#chan", "alfred", now)
+		ld.Replied("#chan", "alfred", now)
+	}
+
+	now = now.Add(replyLoopMinBackoff)
+	ld.Allow("#chan", "carol", now)
+	if len(ld.states) != 2 || len(ld.lastReply) != 0 {
+		t.Fatalf("stale entries kept: %d states, %d replies",
+			len(ld.states), len(ld.lastReply))
+	}
+
+	now = now.Add(replyLoopMaxBackoff)
+	ld.Allow("#chan", "carol", now)
+	if len(ld.states) != 1 {
+		t.Fatalf("stale entries kept: %d states", len(ld.states))
+	}
+}
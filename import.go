@@ -0,0 +1,471 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportCmd holds the parameters of the import command, which converts the
+// logs of an IRC client or bouncer to a structured log.
+type ImportCmd struct {
+	Format  string `short:"f" long:"format" description:"Format of the logs: irssi, weechat, znc, hexchat or mirc" required:"true"`
+	Channel string `short:"C" long:"channel" description:"Channel the logs are from"`
+	Network string `short:"n" long:"network" description:"Network the logs are from"`
+	Output  string `short:"o" long:"output" description:"Structured log to append to instead of the standard output, outside of the data directories: move it there while the bot is stopped"`
+
+	Args struct {
+		Files []string `positional-arg-name:"file" required:"1"`
+	} `positional-args:"yes"`
+}
+
+// logParser extracts the messages of the logs of an IRC client or bouncer,
+// one line at a time.
+type logParser interface {
+	// parseLine returns the record of a message or an action, with its
+	// time, nick, kind and text.  ok is false for anything else (joins,
+	// parts, modes, CTCP...).
+	parseLine(line string) (record LogRecord, ok bool)
+}
+
+// logParsers returns a parser by format name.  The logs are dated in loc,
+// some formats only find the date in the name of the file.
+var logParsers = map[string]func(filename string, loc *time.Location) logParser{
+	"irssi":   newIrssiParser,
+	"weechat": newWeechatParser,
+	"znc":     newZNCParser,
+	"hexchat": newHexChatParser,
+	"mirc":    newMIRCParser,
+}
+
+// getLogFormats returns the names of the supported formats.
+func getLogFormats() []string {
+	var formats []string
+	for format := range logParsers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// runImport converts the log files given on the command line.
+func runImport(command ImportCmd) error {
+	newParser, ok := logParsers[command.Format]
+	if !ok {
+		return fmt.Errorf("unknown format %s (supported: %s)",
+			command.Format, strings.Join(getLogFormats(), ", "))
+	}
+
+	var w io.Writer = os.Stdout
+	if command.Output != "" {
+		if err := checkImportOutput(command.Output); err != nil {
+			return err
+		}
+		output, err := os.OpenFile(command.Output,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+		w = output
+	}
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, filename := range command.Args.Files {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+
+		parser := newParser(filename, time.Local)
+		imported, skipped, err := importLog(bw, file, parser,
+			command.Network, command.Channel)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", filename, err.Error())
+		}
+
+		log.Printf("%s: %d lines imported, %d skipped", filename,
+			imported, skipped)
+	}
+
+	return bw.Flush()
+}
+
+// checkImportOutput refuses to import into a data directory: the snapshots
+// record the size of the data files, the lines appended while the bot runs
+// would be considered as learned and never replayed.
+func checkImportOutput(filename string) error {
+	dir := filepath.Dir(filename)
+	for _, pattern := range []string{"*.snapshot", "autolog-*"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		if len(matches) > 0 {
+			return fmt.Errorf("%s is a data directory (found %s), "+
+				"import elsewhere and move the log there while "+
+				"the bot is stopped", dir, filepath.Base(matches[0]))
+		}
+	}
+
+	return nil
+}
+
+// maxImportLineLength is the length of the longest line read from the logs
+// of a client, longer lines are skipped.
+const maxImportLineLength = 1024 * 1024
+
+// importLog writes the messages found by parser in r as records of the given
+// network and channel.
+func importLog(w io.Writer, r io.Reader, parser logParser, network, channel string) (imported, skipped int, err error) {
+	br := bufio.NewReaderSize(r, maxImportLineLength)
+	for number := 1; ; number++ {
+		data, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			log.Printf("line %d: longer than %d bytes, skipped", number,
+				maxImportLineLength)
+			skipped++
+			if err := skipLine(br); err != nil {
+				return imported, skipped, err
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return imported, skipped, err
+		}
+		if len(data) == 0 {
+			break
+		}
+
+		line := strings.TrimRight(string(data), "\r\n")
+
+		record, ok := parser.parseLine(line)
+		if !ok || record.Text == "" || strings.HasPrefix(record.Text, "\x01") {
+			skipped++
+			continue
+		}
+		record.Network = network
+		record.Channel = channel
+
+		encoded, err := encodeRecord(record)
+		if err != nil {
+			return imported, skipped, err
+		}
+		if _, err := io.WriteString(w, encoded+"\n"); err != nil {
+			return imported, skipped, err
+		}
+		imported++
+	}
+
+	return imported, skipped, nil
+}
+
+// skipLine discards the rest of the current line.
+func skipLine(br *bufio.Reader) error {
+	for {
+		_, err := br.ReadSlice('\n')
+		switch err {
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+var (
+	// reNickModes matches the channel modes clients show before nicks.
+	reNickModes = regexp.MustCompile(`^[ @+%~&!]+`)
+
+	// reLogDate finds a date in the name of a log file (e.g. ZNC's
+	// "2015-06-01.log" or "oftc_#debsquad_20150601.log").
+	reLogDate = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})`)
+)
+
+// logDay dates the clock times found in the logs, which only record the day
+// when it changes.  Until then, the day is unknown (year 1).
+type logDay struct {
+	date time.Time
+	loc  *time.Location
+}
+
+// setDate parses the date of the day with the given layout, the value is
+// kept if it cannot be parsed.
+func (d *logDay) setDate(layout, value string) {
+	date, err := time.ParseInLocation(layout, strings.TrimSpace(value), d.loc)
+	if err == nil {
+		d.date = date
+	}
+}
+
+// at returns the time of a clock time ("15:04" or "15:04:05") on the current
+// day, in UTC.
+func (d *logDay) at(clock string) time.Time {
+	var hour, minute, second int
+	for i, field := range strings.Split(clock, ":") {
+		value, _ := strconv.Atoi(field)
+		switch i {
+		case 0:
+			hour = value
+		case 1:
+			minute = value
+		case 2:
+			second = value
+		}
+	}
+
+	year, month, day := d.date.Date()
+	return time.Date(year, month, day, hour, minute, second, 0,
+		d.loc).UTC()
+}
+
+// record returns the record of a line said by nick, shown with its modes.
+func (d *logDay) record(clock, nick, kind, text string) LogRecord {
+	return LogRecord{
+		Time: d.at(clock),
+		Nick: reNickModes.ReplaceAllString(nick, ""),
+		Kind: kind,
+		Text: text,
+	}
+}
+
+// irssiParser reads the default irssi logs:
+//
+//	--- Log opened Mon Jun 01 12:00:00 2015
+//	12:00 -!- bob [~bob@example.org] has joined #debsquad
+//	12:01 <@bob> le chat dort
+//	12:02  * bob caresse le chat
+//	--- Day changed Tue Jun 02 2015
+type irssiParser struct {
+	logDay
+}
+
+var (
+	reIrssiMessage = regexp.MustCompile(`^(\d\d:\d\d(?::\d\d)?) <([^>]+)> ?(.*)$`)
+	reIrssiAction  = regexp.MustCompile(`^(\d\d:\d\d(?::\d\d)?)\s+\* (\S+) ?(.*)$`)
+)
+
+func newIrssiParser(filename string, loc *time.Location) logParser {
+	return &irssiParser{logDay{loc: loc}}
+}
+
+func (p *irssiParser) parseLine(line string) (LogRecord, bool) {
+	if strings.HasPrefix(line, "--- Log opened ") {
+		p.setDate("Mon Jan _2 15:04:05 2006", line[15:])
+		return LogRecord{}, false
+	}
+	if strings.HasPrefix(line, "--- Day changed ") {
+		p.setDate("Mon Jan _2 2006", line[16:])
+		return LogRecord{}, false
+	}
+
+	if tokens := reIrssiMessage.FindStringSubmatch(line); tokens != nil {
+		return p.record(tokens[1], tokens[2], LogKindMessage, tokens[3]), true
+	}
+	if tokens := reIrssiAction.FindStringSubmatch(line); tokens != nil {
+		return p.record(tokens[1], tokens[2], LogKindAction, tokens[3]), true
+	}
+
+	return LogRecord{}, false
+}
+
+// weechatParser reads the weechat logs, with tab-separated date, prefix and
+// message:
+//
+//	2015-06-01 12:00:00	-->	bob (~bob@example.org) has joined #debsquad
+//	2015-06-01 12:01:00	@bob	le chat dort
+//	2015-06-01 12:02:00	 *	bob caresse le chat
+type weechatParser struct {
+	loc *time.Location
+}
+
+func newWeechatParser(filename string, loc *time.Location) logParser {
+	return &weechatParser{loc: loc}
+}
+
+func (p *weechatParser) parseLine(line string) (LogRecord, bool) {
+	fields := strings.SplitN(line, "\t", 3)
+	if len(fields) != 3 {
+		return LogRecord{}, false
+	}
+
+	day := logDay{loc: p.loc}
+	day.setDate("2006-01-02 15:04:05", fields[0])
+	clock := ""
+	if date := strings.Fields(fields[0]); len(date) == 2 {
+		clock = date[1]
+	}
+
+	// Joins, parts, quits, modes, notices and errors have their own
+	// prefixes, which cannot be nicks.
+	prefix := strings.TrimSpace(fields[1])
+	switch prefix {
+	case "*":
+		nick, text := splitWord(fields[2])
+		return day.record(clock, nick, LogKindAction, text), true
+	case "", "-->", "<--", "--", "=!=":
+		return LogRecord{}, false
+	}
+
+	return day.record(clock, prefix, LogKindMessage, fields[2]), true
+}
+
+// zncParser reads the logs of the ZNC log module, dated by their file name:
+//
+//	[12:00:00] *** Joins: bob (~bob@example.org)
+//	[12:01:00] <bob> le chat dort
+//	[12:02:00] * bob caresse le chat
+type zncParser struct {
+	logDay
+}
+
+var (
+	reZNCMessage = regexp.MustCompile(`^\[(\d\d:\d\d(?::\d\d)?)\] <([^>]+)> ?(.*)$`)
+	reZNCAction  = regexp.MustCompile(`^\[(\d\d:\d\d(?::\d\d)?)\] \* (\S+) ?(.*)$`)
+)
+
+func newZNCParser(filename string, loc *time.Location) logParser {
+	p := &zncParser{logDay{loc: loc}}
+	if tokens := reLogDate.FindStringSubmatch(filepath.Base(filename)); tokens != nil {
+		p.setDate("20060102", tokens[1]+tokens[2]+tokens[3])
+	}
+	return p
+}
+
+func (p *zncParser) parseLine(line string) (LogRecord, bool) {
+	if tokens := reZNCMessage.FindStringSubmatch(line); tokens != nil {
+		return p.record(tokens[1], tokens[2], LogKindMessage, tokens[3]), true
+	}
+	if tokens := reZNCAction.FindStringSubmatch(line); tokens != nil {
+		return p.record(tokens[1], tokens[2], LogKindAction, tokens[3]), true
+	}
+
+	return LogRecord{}, false
+}
+
+// hexChatParser reads the HexChat logs, whose timestamps have no year:
+//
+//	**** BEGIN LOGGING AT Mon Jun  1 12:00:00 2015
+//	Jun 01 12:00:00 -->	bob (~bob@example.org) has joined #debsquad
+//	Jun 01 12:01:00 <bob>	le chat dort
+//	Jun 01 12:02:00 *	bob caresse le chat
+type hexChatParser struct {
+	logDay
+}
+
+var reHexChatLine = regexp.MustCompile(`^(\w{3} [ \d]\d) (\d\d:\d\d:\d\d) ([^\t]*)\t(.*)$`)
+
+func newHexChatParser(filename string, loc *time.Location) logParser {
+	return &hexChatParser{logDay{loc: loc}}
+}
+
+func (p *hexChatParser) parseLine(line string) (LogRecord, bool) {
+	if strings.HasPrefix(line, "**** BEGIN LOGGING AT ") {
+		p.setDate("Mon Jan _2 15:04:05 2006", line[22:])
+		return LogRecord{}, false
+	}
+
+	tokens := reHexChatLine.FindStringSubmatch(line)
+	if tokens == nil {
+		return LogRecord{}, false
+	}
+
+	// The year comes from the last header, unless the log went past the
+	// new year since.
+	day := logDay{loc: p.loc}
+	day.setDate("Jan _2", tokens[1])
+	month, year := day.date.Month(), p.date.Year()
+	if month < p.date.Month() {
+		year++
+	}
+	day.date = time.Date(year, month, day.date.Day(), 0, 0, 0, 0, p.loc)
+
+	prefix, text := tokens[3], tokens[4]
+	switch {
+	case prefix == "*":
+		nick, text := splitWord(text)
+		return day.record(tokens[2], nick, LogKindAction, text), true
+	case strings.HasPrefix(prefix, "<") && strings.HasSuffix(prefix, ">"):
+		nick := prefix[1 : len(prefix)-1]
+		return day.record(tokens[2], nick, LogKindMessage, text), true
+	}
+
+	return LogRecord{}, false
+}
+
+// mircParser reads the mIRC logs, where actions and events both start with a
+// star:
+//
+//	Session Start: Mon Jun 01 12:00:00 2015
+//	[12:00] * bob (~bob@example.org) has joined #debsquad
+//	[12:01] <@bob> le chat dort
+//	[12:02] * bob caresse le chat
+type mircParser struct {
+	logDay
+}
+
+var (
+	reMIRCLine = regexp.MustCompile(`^(?:\[(\d\d:\d\d(?::\d\d)?)\] )?(.*)$`)
+
+	reMIRCMessage = regexp.MustCompile(`^<([^>]+)> ?(.*)$`)
+	reMIRCAction  = regexp.MustCompile(`^\* (\S+) ?(.*)$`)
+
+	// reMIRCEvent matches the events shown like actions.
+	reMIRCEvent = regexp.MustCompile(`^\* (?:` +
+		`\S+ (?:\(\S+\) )?has (?:joined|left|quit)|` +
+		`\S+ (?:sets mode:|is now known as|was kicked by|changes topic to)|` +
+		`(?:Joins|Parts|Quits|Now talking in|Topic is|Set by|` +
+		`Disconnected|Attempting to rejoin|Rejoined|Retrieving)\b)`)
+)
+
+func newMIRCParser(filename string, loc *time.Location) logParser {
+	return &mircParser{logDay{loc: loc}}
+}
+
+func (p *mircParser) parseLine(line string) (LogRecord, bool) {
+	for _, header := range []string{"Session Start: ", "Session Time: "} {
+		if strings.HasPrefix(line, header) {
+			p.setDate("Mon Jan _2 15:04:05 2006", line[len(header):])
+			return LogRecord{}, false
+		}
+	}
+
+	tokens := reMIRCLine.FindStringSubmatch(line)
+	clock, rest := tokens[1], tokens[2]
+
+	if tokens := reMIRCMessage.FindStringSubmatch(rest); tokens != nil {
+		return p.record(clock, tokens[1], LogKindMessage, tokens[2]), true
+	}
+	if reMIRCEvent.MatchString(rest) {
+		return LogRecord{}, false
+	}
+	if tokens := reMIRCAction.FindStringSubmatch(rest); tokens != nil {
+		return p.record(clock, tokens[1], LogKindAction, tokens[2]), true
+	}
+
+	return LogRecord{}, false
+}
+
+// splitWord returns the first word of s and the rest.
+func splitWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
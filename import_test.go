@@ -0,0 +1,172 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// importedLine is what is expected from a line of the logs.
+type importedLine struct {
+	time string
+	nick string
+	line string
+}
+
+func testImport(t *testing.T, format, filename, logs string, expected []importedLine) {
+	t.Helper()
+
+	var output bytes.Buffer
+	parser := logParsers[format](filename, time.UTC)
+	imported, _, err := importLog(&output, strings.NewReader(logs), parser,
+		"oftc", "#debsquad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != len(expected) {
+		t.Fatalf("%s: wrong number of lines imported: %d\n%s", format,
+			imported, output.String())
+	}
+
+	decoder := json.NewDecoder(&output)
+	for _, line := range expected {
+		var record LogRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Time.Format(time.RFC3339) != line.time ||
+			record.Nick != line.nick || record.Line() != line.line ||
+			record.Network != "oftc" || record.Channel != "#debsquad" {
+			t.Fatalf("%s: wrong record %+v, expected %+v", format,
+				record, line)
+		}
+	}
+}
+
+func TestImportIrssi(t *testing.T) {
+	testImport(t, "irssi", "debsquad.log", `--- Log opened Mon Jun 01 12:00:00 2015
+12:00 -!- bob [~bob@example.org] has joined #debsquad
+12:00 -!- mode/#debsquad [+o bob] by ChanServ
+12:01 <@bob> le chat dort
+12:01 < alice> le chien <3
+12:02  * bob caresse le chat
+12:03 -!- CTCP VERSION request from alice
+12:04 -!- bob [~bob@example.org] has quit [Quit: bye]
+--- Day changed Tue Jun 02 2015
+00:10 <+alice> minuit passé
+--- Log closed Tue Jun 02 00:20:00 2015
+`, []importedLine{
+		{"2015-06-01T12:01:00Z", "bob", "le chat dort"},
+		{"2015-06-01T12:01:00Z", "alice", "le chien <3"},
+		{"2015-06-01T12:02:00Z", "bob", "ACTION caresse le chat"},
+		{"2015-06-02T00:10:00Z", "alice", "minuit passé"},
+	})
+}
+
+func TestImportWeechat(t *testing.T) {
+	testImport(t, "weechat", "irc.oftc.#debsquad.weechatlog", "2015-06-01 12:00:00\t-->\tbob (~bob@example.org) has joined #debsquad\n"+
+		"2015-06-01 12:00:05\t--\tMode #debsquad [+o bob] by ChanServ\n"+
+		"2015-06-01 12:01:00\t@bob\tle chat dort\n"+
+		"2015-06-01 12:02:00\t *\tbob caresse le chat\n"+
+		"2015-06-01 12:03:00\t--\tCTCP requested by alice: VERSION\n"+
+		"2015-06-01 12:03:30\talice\t\x01PING 1234\x01\n"+
+		"2015-06-01 12:04:00\t<--\tbob (~bob@example.org) has quit (bye)\n"+
+		"2015-06-01 12:05:00\talice\tle chien dort\n", []importedLine{
+		{"2015-06-01T12:01:00Z", "bob", "le chat dort"},
+		{"2015-06-01T12:02:00Z", "bob", "ACTION caresse le chat"},
+		{"2015-06-01T12:05:00Z", "alice", "le chien dort"},
+	})
+}
+
+func TestImportZNC(t *testing.T) {
+	testImport(t, "znc", "logs/oftc/#debsquad/2015-06-01.log", `[12:00:00] *** Joins: bob (~bob@example.org)
+[12:00:05] *** ChanServ sets mode: +o bob
+[12:01:00] <bob> le chat dort
+[12:02:00] * bob caresse le chat
+[12:03:00] -alice- hello
+[12:04:00] *** Quits: bob (~bob@example.org) (bye)
+`, []importedLine{
+		{"2015-06-01T12:01:00Z", "bob", "le chat dort"},
+		{"2015-06-01T12:02:00Z", "bob", "ACTION caresse le chat"},
+	})
+}
+
+func TestImportHexChat(t *testing.T) {
+	testImport(t, "hexchat", "oftc/#debsquad.log", "**** BEGIN LOGGING AT Thu Dec 31 23:00:00 2015\n"+
+		"Dec 31 23:00:00 -->\tbob (~bob@example.org) has joined #debsquad\n"+
+		"Dec 31 23:01:00 <@bob>\tle chat dort\n"+
+		"Dec 31 23:02:00 *\tbob caresse le chat\n"+
+		"Dec 31 23:03:00 ---\tChanServ gives channel operator status to bob\n"+
+		"Dec 31 23:03:30 >alice<\tVERSION\n"+
+		"Jan 01 00:01:00 <alice>\tbonne année\n"+
+		"Jan 01 00:02:00 <--\tbob (~bob@example.org) has quit (bye)\n", []importedLine{
+		{"2015-12-31T23:01:00Z", "bob", "le chat dort"},
+		{"2015-12-31T23:02:00Z", "bob", "ACTION caresse le chat"},
+		{"2016-01-01T00:01:00Z", "alice", "bonne année"},
+	})
+}
+
+func TestImportMIRC(t *testing.T) {
+	testImport(t, "mirc", "#debsquad.log", `Session Start: Mon Jun 01 12:00:00 2015
+Session Ident: #debsquad
+[12:00] * Now talking in #debsquad
+[12:00] * bob (~bob@example.org) has joined #debsquad
+[12:00] * ChanServ sets mode: +o bob
+[12:01] <@bob> le chat dort
+[12:02] * bob caresse le chat
+[12:03] [alice VERSION]
+[12:04] * alice is now known as alice_
+[12:05] * bob has quit IRC (Quit: bye)
+Session Close: Mon Jun 01 12:06:00 2015
+`, []importedLine{
+		{"2015-06-01T12:01:00Z", "bob", "le chat dort"},
+		{"2015-06-01T12:02:00Z", "bob", "ACTION caresse le chat"},
+	})
+}
+
+func TestImportRefusesDataDirectory(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "irssi.log")
+	err := ioutil.WriteFile(input, []byte("12:01 <bob> le chat dort\n"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command := ImportCmd{Format: "irssi", Output: filepath.Join(dir, "debsquad.jsonl")}
+	command.Args.Files = []string{input}
+	if err := runImport(command); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the directory holds a snapshot, the bot may be running.
+	snapshot := filepath.Join(dir, "chain.snapshot")
+	if err := ioutil.WriteFile(snapshot, nil, 0660); err != nil {
+		t.Fatal(err)
+	}
+	command.Output = filepath.Join(dir, "autolog-#debsquad.jsonl")
+	if err := runImport(command); err == nil {
+		t.Fatal("imported into a data directory")
+	}
+	if _, err := os.Stat(command.Output); !os.IsNotExist(err) {
+		t.Fatal("data directory written to")
+	}
+}
+
+func TestImportLongLines(t *testing.T) {
+	long := strings.TrimSpace(strings.Repeat("chat ", 20000))
+	tooLong := strings.Repeat("chien ", maxImportLineLength)
+	testImport(t, "znc", "2015-06-01.log", "[12:00:00] <bob> "+long+"\n"+
+		"[12:01:00] <bob> "+tooLong+"\n"+
+		"[12:02:00] <alice> le chat dort", []importedLine{
+		{"2015-06-01T12:00:00Z", "bob", long},
+		{"2015-06-01T12:02:00Z", "alice", "le chat dort"},
+	})
+}
@@ -6,48 +6,105 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
-	"time"
 )
 
-// privMsg sends a message to a channel.
-func privMsg(channel, msg string) {
-	lines := strings.Split(msg, "\n")
-	for i := 0; i < len(lines); i++ {
-		if lines[i] == "" {
-			continue
+// isChannel returns true if target is a channel name, as opposed to a nick
+// (private messages are sent to our own nick).
+func isChannel(target string) bool {
+	return target != "" && strings.ContainsRune("#&+!", rune(target[0]))
+}
+
+// ircLower folds a nick or a channel name with the rfc1459 casemapping, the
+// default of most servers: on top of ASCII, "[]\\~" are the uppercase forms
+// of "{}|^".
+func ircLower(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		case r == '[':
+			return '{'
+		case r == ']':
+			return '}'
+		case r == '\\':
+			return '|'
+		case r == '~':
+			return '^'
 		}
-		IRCOutgoing <- fmt.Sprintf("PRIVMSG %s :%s", channel, lines[i])
+		return r
+	}, name)
+}
 
-		// Make test mode faster.
-		if cfg.TestMode {
-			time.Sleep(50 * time.Millisecond)
-		} else {
-			time.Sleep(500 * time.Millisecond)
+// ircEqual returns true if two nicks or channel names are the same under the
+// rfc1459 casemapping.
+func ircEqual(a, b string) bool {
+	return ircLower(a) == ircLower(b)
+}
+
+// Privmsg sends a message to a channel, one line at a time.  There is no
+// throttling here, see OutgoingQueue.
+func (t *nativeTransport) Privmsg(channel, msg string) {
+	if strings.EqualFold(channel, nickServ) {
+		t.privmsgServices(channel, msg)
+		return
+	}
+
+	for _, line := range strings.Split(msg, "\n") {
+		if line == "" {
+			continue
 		}
+
+		t.expectEcho(channel, line)
+		t.send(fmt.Sprintf("PRIVMSG %s :%s", channel, line))
 	}
 }
 
-// privAction sends an action message to a channel.
-func privAction(channel, msg string) {
-	IRCOutgoing <- fmt.Sprintf("PRIVMSG %s :\x01ACTION %s\x01", channel, msg)
+// privmsgServices sends a command to the services, which may hold a password:
+// its echo is not waited for, it would only end up in the logs.
+func (t *nativeTransport) privmsgServices(target, msg string) {
+	t.send(fmt.Sprintf("PRIVMSG %s :%s", target, msg))
+}
+
+// Action sends an action message to a channel.
+func (t *nativeTransport) Action(channel, msg string) {
+	text := fmt.Sprintf("\x01ACTION %s\x01", msg)
+	t.expectEcho(channel, text)
+	t.send(fmt.Sprintf("PRIVMSG %s :%s", channel, text))
+}
+
+// Join sends a JOIN command.
+func (t *nativeTransport) Join(channel string) {
+	t.send("JOIN " + channel)
 }
 
-// join sends a JOIN command.
-func join(channel string) {
-	IRCOutgoing <- "JOIN " + channel
+// welcome is called once the bot is registered with the server.
+func (n *Network) welcome() {
+	n.supervisor.Welcomed()
+	n.nickServWelcome()
+	n.autojoin()
 }
 
-// Auto-join all the configured channels.
-func autojoin() {
-	// Make test mode faster.
-	if cfg.TestMode {
-		time.Sleep(50 * time.Millisecond)
-	} else {
-		time.Sleep(500 * time.Millisecond)
+// Auto-join all the configured channels, along with the channels joined before
+// a reconnection.
+func (n *Network) autojoin() {
+	channels := make(map[string]string)
+	for _, c := range n.config.GetAutoJoinChannels() {
+		channels[ircLower(c)] = c
+	}
+	for _, c := range n.supervisor.Channels() {
+		if _, ok := channels[ircLower(c)]; !ok {
+			channels[ircLower(c)] = c
+		}
 	}
 
-	for _, c := range cfg.GetAutoJoinChannels() {
-		join(c)
+	joining := make([]string, 0, len(channels))
+	for _, c := range channels {
+		joining = append(joining, c)
+	}
+	sort.Strings(joining)
+	for _, c := range joining {
+		n.transport.Join(c)
 	}
 }
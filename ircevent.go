@@ -0,0 +1,166 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// ircEventTransport is a Transport backed by github.com/thoj/go-ircevent.
+type ircEventTransport struct {
+	options  TransportOptions
+	handlers EventHandlers
+	conn     *irc.Connection
+
+	mutex    sync.Mutex
+	hostmask string
+	quitting bool
+}
+
+func newIRCEventTransport(options TransportOptions, handlers EventHandlers) *ircEventTransport {
+	return &ircEventTransport{
+		options:  options,
+		handlers: handlers,
+	}
+}
+
+// getEventSpeaker returns the author of an IRC event.
+func getEventSpeaker(e *irc.Event) Speaker {
+	return Speaker{
+		Nick:    e.Nick,
+		User:    e.User,
+		Host:    e.Host,
+		Account: tagAccount(e.Tags),
+	}
+}
+
+// Connect creates the go-ircevent connection and dials the server.
+func (t *ircEventTransport) Connect() error {
+	t.conn = irc.IRC(t.options.Nick, t.options.Nick)
+	t.conn.VerboseCallbackHandler = true
+	t.conn.Debug = !t.options.Quiet
+	t.conn.RequestCaps = []string{"message-tags", "server-time",
+		"account-tag"}
+
+	if t.options.TLSConfig != nil {
+		t.conn.UseTLS = true
+		t.conn.TLSConfig = t.options.TLSConfig
+	}
+
+	if t.options.SASLMechanism != "" {
+		t.conn.UseSASL = true
+		t.conn.SASLMech = t.options.SASLMechanism
+		t.conn.SASLLogin = t.options.SASLLogin
+		t.conn.SASLPassword = t.options.SASLPassword
+	}
+
+	t.conn.AddCallback("001", func(e *irc.Event) {
+		if t.handlers.Welcome != nil {
+			t.handlers.Welcome()
+		}
+	})
+	t.conn.AddCallback("NICK", func(e *irc.Event) {
+		// go-ircevent already updated our nick.
+		if ircEqual(e.Message(), t.conn.GetNick()) &&
+			t.handlers.NickChanged != nil {
+			t.handlers.NickChanged(e.Message())
+		}
+	})
+	t.conn.AddCallback("JOIN", func(e *irc.Event) {
+		if !ircEqual(e.Nick, t.conn.GetNick()) {
+			return
+		}
+
+		t.mutex.Lock()
+		t.hostmask = e.Source
+		t.mutex.Unlock()
+
+		if t.handlers.Joined != nil {
+			t.handlers.Joined(e.Arguments[0])
+		}
+	})
+	t.conn.AddCallback("PART", func(e *irc.Event) {
+		if ircEqual(e.Nick, t.conn.GetNick()) && t.handlers.Parted != nil {
+			t.handlers.Parted(e.Arguments[0])
+		}
+	})
+	t.conn.AddCallback("KICK", func(e *irc.Event) {
+		if len(e.Arguments) > 1 && ircEqual(e.Arguments[1], t.conn.GetNick()) &&
+			t.handlers.Parted != nil {
+			t.handlers.Parted(e.Arguments[0])
+		}
+	})
+	t.conn.AddCallback("PRIVMSG", func(e *irc.Event) {
+		if t.handlers.Message != nil {
+			t.handlers.Message(getEventSpeaker(e), e.Arguments[0],
+				e.Message(), tagTime(e.Tags))
+		}
+	})
+	t.conn.AddCallback("CTCP_ACTION", func(e *irc.Event) {
+		if t.handlers.Action != nil {
+			t.handlers.Action(getEventSpeaker(e), e.Arguments[0],
+				e.Message(), tagTime(e.Tags))
+		}
+	})
+
+	return t.conn.Connect(t.options.Server)
+}
+
+// Loop waits until the connection is lost and returns why, or nil after Quit.
+// go-ircevent's own Loop is not used since it reconnects by itself, which
+// would bypass the Supervisor.
+func (t *ircEventTransport) Loop() error {
+	err := <-t.conn.ErrorChan()
+	t.conn.Disconnect()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.quitting {
+		return nil
+	}
+	return err
+}
+
+// Nick returns the current nick of the bot.
+func (t *ircEventTransport) Nick() string {
+	return t.conn.GetNick()
+}
+
+// Hostmask returns our nick!user@host, learned from our last JOIN.
+func (t *ircEventTransport) Hostmask() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.hostmask
+}
+
+// SetNick asks the server to change our nick.
+func (t *ircEventTransport) SetNick(nick string) {
+	t.conn.Nick(nick)
+}
+
+// Join sends a JOIN command.
+func (t *ircEventTransport) Join(channel string) {
+	t.conn.Join(channel)
+}
+
+// Privmsg sends a message to a channel or a nick.
+func (t *ircEventTransport) Privmsg(target, msg string) {
+	t.conn.Privmsg(target, msg)
+}
+
+// Action sends an action to a channel or a nick.
+func (t *ircEventTransport) Action(target, msg string) {
+	t.conn.Action(target, msg)
+}
+
+// Quit disconnects from the server.
+func (t *ircEventTransport) Quit() {
+	t.mutex.Lock()
+	t.quitting = true
+	t.mutex.Unlock()
+
+	t.conn.Quit()
+}
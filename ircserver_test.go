@@ -0,0 +1,244 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServerTimeout is how long the fake server waits for the bot.
+const fakeServerTimeout = 5 * time.Second
+
+// fakeServer is a scripted IRC server listening on localhost.  Tests accept the
+// connection of the bot, then alternate between sending lines and asserting
+// the exact lines sent back by the bot.
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+	accepted chan net.Conn
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+// newFakeServer starts listening on a random localhost port, the server is
+// closed at the end of the test.
+func newFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return startFakeServer(t, listener)
+}
+
+// newFakeTLSServer starts a fake server over TLS, with a self-signed
+// certificate for 127.0.0.1.  Client certificates are requested but not
+// verified.  It returns the server and the PEM file of its certificate.
+func newFakeTLSServer(t *testing.T) (*fakeServer, string) {
+	cert, certFile, _ := newTestCertificate(t, "server")
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return startFakeServer(t, listener), certFile
+}
+
+// startFakeServer accepts the connections in the background so the bot can
+// complete the TLS handshake while dialing.
+func startFakeServer(t *testing.T, listener net.Listener) *fakeServer {
+	server := &fakeServer{
+		t:        t,
+		listener: listener,
+		accepted: make(chan net.Conn, 4),
+	}
+	t.Cleanup(server.Close)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					continue
+				}
+			}
+			server.accepted <- conn
+		}
+	}()
+
+	return server
+}
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1 and
+// writes it to PEM files.
+func newTestCertificate(t *testing.T, name string) (tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, certFile, keyFile
+}
+
+// Addr returns the host:port the server listens on.
+func (server *fakeServer) Addr() string {
+	return server.listener.Addr().String()
+}
+
+// Accept waits for the bot to connect.
+func (server *fakeServer) Accept() {
+	server.t.Helper()
+
+	select {
+	case conn := <-server.accepted:
+		server.conn = conn
+		server.reader = bufio.NewReader(conn)
+	case <-time.After(fakeServerTimeout):
+		server.t.Fatal("fake server: the bot did not connect")
+	}
+}
+
+// Send writes a line to the bot.
+func (server *fakeServer) Send(format string, args ...interface{}) {
+	server.t.Helper()
+
+	line := fmt.Sprintf(format, args...)
+	if _, err := fmt.Fprintf(server.conn, "%s\r\n", line); err != nil {
+		server.t.Fatalf("fake server: unable to send %q: %s", line, err)
+	}
+}
+
+// ReadLine returns the next line sent by the bot.
+func (server *fakeServer) ReadLine() string {
+	server.t.Helper()
+
+	server.conn.SetReadDeadline(time.Now().Add(fakeServerTimeout))
+	line, err := server.reader.ReadString('\n')
+	if err != nil {
+		server.t.Fatalf("fake server: nothing received: %s", err)
+	}
+
+	return strings.TrimRight(line, "\r\n")
+}
+
+// Expect asserts the next line sent by the bot.
+func (server *fakeServer) Expect(expected string) {
+	server.t.Helper()
+
+	if line := server.ReadLine(); line != expected {
+		server.t.Fatalf("fake server: expected %q, got %q", expected, line)
+	}
+}
+
+// Sync makes sure the bot processed all the lines sent so far, the bot
+// handles lines in order so once it answers a PING, it is done with
+// everything before it.
+func (server *fakeServer) Sync() {
+	server.t.Helper()
+
+	server.Send("PING :sync")
+	server.Expect("PONG :sync")
+}
+
+// Register completes the registration of the bot with the given nick, the
+// server supports the given capabilities.
+func (server *fakeServer) Register(nick string, caps ...string) {
+	server.t.Helper()
+
+	server.Expect("CAP LS 302")
+	server.Expect("NICK " + nick)
+	server.Expect(fmt.Sprintf("USER %s localhost 127.0.0.1 :%s", nick, nick))
+	server.Send(":irc.example.org CAP * LS :%s", strings.Join(caps, " "))
+	if len(caps) > 0 {
+		server.Expect("CAP REQ :" + strings.Join(caps, " "))
+		server.Send(":irc.example.org CAP %s ACK :%s", nick,
+			strings.Join(caps, " "))
+	}
+	server.Expect("CAP END")
+	server.Send(":irc.example.org 001 %s :Welcome to the fake IRC server", nick)
+}
+
+// Disconnect closes the connection to the bot, the server keeps listening.
+func (server *fakeServer) Disconnect() {
+	server.conn.Close()
+}
+
+// PeerCertificates returns the certificates presented by the bot over TLS.
+func (server *fakeServer) PeerCertificates() []*x509.Certificate {
+	tlsConn, ok := server.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	return tlsConn.ConnectionState().PeerCertificates
+}
+
+// Close stops the server and closes the connection to the bot.
+func (server *fakeServer) Close() {
+	if server.conn != nil {
+		server.conn.Close()
+	}
+	server.listener.Close()
+}
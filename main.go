@@ -4,119 +4,328 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
-
-	"github.com/thoj/go-ircevent"
+	"sync"
+	"syscall"
+	"time"
 )
 
-// These channels represent the lines coming and going to the IRC server (from
-// the perspective of this program).
 var (
-	IRCIncoming   = make(chan string)
-	IRCOutgoing   = make(chan string)
-	IRCDisconnect = make(chan string)
+	// Detect if we are addressed to, nicks may contain []\`^{}|-.
+	reAddressed = regexp.MustCompile(`^([\w\[\]\\^{}|` + "`" +
+		`-]+)[:,.]*\s*(.*)`)
 
-	conn *irc.Connection
+	// Detect a request to generate with a given seed (e.g. to reproduce
+	// a previous answer): "seed 1234 topic".
+	reSeed = regexp.MustCompile(`^seed\s+(-?[0-9]+)\s*(.*)`)
 
-	// Detect if we are addressed to.
-	reAddressed = regexp.MustCompile(`^(\w+)[:,.]*\s*(.*)`)
+	// Detect a request to imitate someone: "imite bob topic".
+	reImitate = regexp.MustCompile(`^imite\s+(\S+)\s*(.*)`)
 )
 
 var (
-	chain *Chain
+	// testModeOutput receives the messages sent while in TestMode.
+	testModeOutput io.Writer = os.Stdout
 )
 
-func logLine(channel, line string) {
-	filename := cfg.MarkovDataPath + "/autolog-" + channel + ".txt"
-
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
-	if err != nil {
-		log.Printf("Error opening %s for logging: %s", filename,
-			err.Error())
+// MessageHandler is called for every single message, it records sentences and
+// makes the bot respond if the sentence is addressed at the bot.  Private
+// messages (target is our own nick) are always considered addressed to the
+// bot and answered to their author.  at is when the message was sent.
+func (n *Network) MessageHandler(speaker Speaker, target, body string, at time.Time) {
+	// Drop anything coming from the ignored speakers (other bots).
+	if isIgnored(n.config.Ignore, speaker) {
 		return
 	}
-	defer f.Close()
 
-	_, err = f.WriteString(line + "\n")
-	if err != nil {
-		log.Printf("Error writing to %s for logging: %s", filename,
-			err.Error())
-		return
+	private := !isChannel(target)
+	if private {
+		target = speaker.Nick
 	}
-}
 
-// MessageHandler is called for every single message, it records sentences and
-// makes the bot respond if the sentence is addressed at the bot.
-func MessageHandler(nick, target, body string) {
 	// We will only respond to a user if they address us, also we won't
 	// increment the markov chain with what people tell us since it's often
 	// gibberish.
+	line := body
 	tokens := reAddressed.FindStringSubmatch(body)
-	addressed := tokens != nil && tokens[1] == cfg.IRCNickname
-	if !addressed {
-		addToMarkov(target, body)
+	addressed := tokens != nil && n.isOwnNick(tokens[1])
+	if addressed {
+		body = tokens[2]
+	}
+
+	// Opting out must not be learned.
+	if (addressed || private) && n.optOut(speaker, target, body) {
+		return
+	}
+
+	if private {
+		if n.config.LearnFromPrivateMessages {
+			n.addToMarkov(speaker, target, LogKindMessage, line, at)
+		}
+	} else if !addressed {
+		n.addToMarkov(speaker, target, LogKindMessage, line, at)
 		return
 	}
-	body = tokens[2]
 
 	// Avoid (up|down)votes from generating a chain.
 	if body == "++" || body == "--" {
 		return
 	}
 
-	output := chain.GenerateOnTopic(10, body)
+	// Don't feed a conversation with another bot.
+	now := time.Now()
+	if !n.replyLoops.Allow(target, speaker.Nick, now) {
+		log.Printf("reply loop with %s on %s, backing off",
+			speaker.Nick, target)
+		return
+	}
+	n.replyLoops.Replied(target, speaker.Nick, now)
+
+	if body == "status" {
+		n.sendMessage(target, n.supervisor.Status())
+		return
+	}
+
+	if body == "seed?" {
+		n.sendLastSeed(target)
+		return
+	}
 
-	// Handle possibly generated ACTIONs.
+	if tokens := reImitate.FindStringSubmatch(body); tokens != nil &&
+		n.models.Learner(target).SpeakersPath != "" {
+		n.imitate(target, tokens[1], tokens[2])
+		return
+	}
+
+	seed, body := parseSeed(n.models.Learner(target).Chain, body)
+	model := n.models.Blend(target).Pick(seed, body)
+	log.Printf("generating on %q from %s with seed %d", body, model.Name,
+		seed)
+	n.rememberSeed(target, fmt.Sprintf("seed %d %s", seed, body))
+	n.answer(target, model.Chain.WithSeed(seed).GenerateOnTopic(10, body))
+}
+
+// answer sends a generated line to target, as an action if it was generated
+// from one.
+func (n *Network) answer(target, output string) {
 	if strings.HasPrefix(output, "ACTION ") {
 		output = output[7:]
-		conn.Action(target, output)
+		n.sendAction(target, output)
 	} else {
-		conn.Privmsg(target, output)
+		n.sendMessage(target, output)
+	}
+}
+
+// sendMessage sends a message to the target, or prints it in TestMode.
+func (n *Network) sendMessage(target, msg string) {
+	if cfg.TestMode {
+		fmt.Fprintf(testModeOutput, "PRIVMSG %s :%s\n", target, msg)
+		return
 	}
+	n.sendQueue.Privmsg(target, msg)
 }
 
-func addToMarkov(target, body string) {
-	chain.AddLine(body)
-	logLine(target, body)
+// sendAction sends an action to the target, or prints it in TestMode.
+func (n *Network) sendAction(target, msg string) {
+	if cfg.TestMode {
+		fmt.Fprintf(testModeOutput, "ACTION %s :%s\n", target, msg)
+		return
+	}
+	n.sendQueue.Action(target, msg)
+}
+
+// parseSeed extracts the seed requested in body, if any, and returns it along
+// with the rest of the body.  A new seed is drawn from chain if none was
+// requested.
+func parseSeed(chain *Chain, body string) (int64, string) {
+	tokens := reSeed.FindStringSubmatch(body)
+	if tokens != nil {
+		seed, err := strconv.ParseInt(tokens[1], 10, 64)
+		if err == nil {
+			return seed, tokens[2]
+		}
+	}
+
+	return chain.NewSeed(), body
+}
+
+// rememberSeed records request as the one reproducing the last answer sent to
+// target.
+func (n *Network) rememberSeed(target, request string) {
+	n.lastSeedsMutex.Lock()
+	defer n.lastSeedsMutex.Unlock()
+	n.lastSeeds[ircLower(target)] = strings.TrimSpace(request)
+}
+
+// sendLastSeed tells target how to reproduce the last answer it was sent.
+func (n *Network) sendLastSeed(target string) {
+	n.lastSeedsMutex.Lock()
+	request, ok := n.lastSeeds[ircLower(target)]
+	n.lastSeedsMutex.Unlock()
+
+	if !ok {
+		n.sendMessage(target, "je n'ai encore rien dit ici")
+		return
+	}
+	n.sendMessage(target, request)
+}
+
+// ActionHandler is called for every CTCP ACTION, they are learned with an
+// "ACTION " prefix so the bot can generate actions of its own, see
+// LogRecord.Line.
+func (n *Network) ActionHandler(speaker Speaker, target, body string, at time.Time) {
+	if isIgnored(n.config.Ignore, speaker) {
+		return
+	}
+
+	if !isChannel(target) {
+		if !n.config.LearnFromPrivateMessages {
+			return
+		}
+		target = speaker.Nick
+	}
+
+	n.addToMarkov(speaker, target, LogKindAction, body, at)
+}
+
+// addToMarkov learns a line of the given kind and logs it, unless its speaker
+// opted out.  at is when it was sent according to the server (server-time),
+// which differs from now on replayed history.
+func (n *Network) addToMarkov(speaker Speaker, target, kind, body string, at time.Time) {
+	if optOuts.Has(n.config.Name, speaker) {
+		return
+	}
+
+	log.Printf("[%s] learning %s from %s on %s (%s): %s", n.config.Name,
+		kind, speaker.Nick, target, at.Format(time.RFC3339), body)
+	n.models.Learner(target).Learn(LogRecord{
+		Time:    at.UTC(),
+		Network: n.config.Name,
+		Channel: target,
+		Nick:    speaker.Nick,
+		Account: speaker.Account,
+		Kind:    kind,
+		Text:    body,
+	})
+}
+
+// snapshotLoop periodically saves the markov models.
+func snapshotLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		snapshotModels()
+	}
+}
+
+// handleSignals saves the markov chain before leaving upon SIGINT/SIGTERM.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Printf("received %s, shutting down", sig)
+	snapshotModels()
+	unlockRunning()
+	os.Exit(0)
+}
+
+// runningFilename is the file written in the data directory while the bot
+// runs, with its process ID.
+const runningFilename = "paglop.pid"
+
+// lockRunning records that the bot is running, for the commands that must not
+// run at the same time (see checkNotRunning).  A file left by a bot that did
+// not shut down cleanly is replaced.
+func lockRunning() error {
+	filename := filepath.Join(cfg.MarkovDataPath, runningFilename)
+	pid := strconv.Itoa(os.Getpid()) + "\n"
+	return ioutil.WriteFile(filename, []byte(pid), 0660)
+}
+
+// unlockRunning removes the file written by lockRunning.
+func unlockRunning() {
+	filename := filepath.Join(cfg.MarkovDataPath, runningFilename)
+	if err := os.Remove(filename); err != nil {
+		log.Printf("unlock error: %s", err.Error())
+	}
+}
+
+// checkNotRunning returns an error if the bot seems to be running.  A bot that
+// crashed leaves its file behind, it must then be removed by hand.
+func checkNotRunning() error {
+	filename := filepath.Join(cfg.MarkovDataPath, runningFilename)
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("the bot is running (remove %s if it is not)",
+			filename)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func main() {
-	parseCommandLine()
+	command := parseCommandLine()
+
+	// Importing logs does not need any configuration.
+	if command == CommandImport {
+		if err := runImport(cmd.Import); err != nil {
+			log.Fatal("import error: ", err.Error())
+		}
+		return
+	}
+
 	err := parseConfigFile()
 	if err != nil {
 		log.Fatal("config error: ", err.Error())
 	}
 
-	log.Printf("initialize markov chain...")
-	chain = initializeMarkovChain(cfg.MarkovDataPath)
-
-	conn = irc.IRC(cfg.IRCNickname, cfg.IRCNickname)
-	conn.VerboseCallbackHandler = true
-	conn.Debug = true
-	err = conn.Connect(cfg.IRCServer)
-	if err != nil {
-		log.Fatal(err)
+	switch command {
+	case CommandMigrateLogs:
+		if err := migrateLogs(); err != nil {
+			log.Fatal("migration error: ", err.Error())
+		}
+		return
 	}
 
-	conn.AddCallback("001", func(e *irc.Event) {
-		for _, c := range cfg.GetAutoJoinChannels() {
-			conn.Join(c)
+	registries := loadModels()
+
+	var networks []*Network
+	for _, config := range cfg.Networks {
+		network, err := NewNetwork(config, registries[config.Name])
+		if err != nil {
+			log.Fatalf("network '%s': %s", config.Name, err.Error())
 		}
-	})
+		networks = append(networks, network)
+	}
 
-	conn.AddCallback("PRIVMSG", func(e *irc.Event) {
-		MessageHandler(e.Nick, e.Arguments[0], e.Message())
-	})
-	conn.AddCallback("CTCP_ACTION", func(e *irc.Event) {
-		body := "ACTION " + e.Message()
-		target := e.Arguments[0]
-		addToMarkov(target, body)
-	})
+	if err := lockRunning(); err != nil {
+		log.Fatal("lock error: ", err.Error())
+	}
 
-	conn.Loop()
+	go handleSignals()
+	if interval := cfg.GetSnapshotInterval(); interval > 0 {
+		go snapshotLoop(interval)
+	}
+
+	var wg sync.WaitGroup
+	for _, network := range networks {
+		wg.Add(1)
+		go func(network *Network) {
+			defer wg.Done()
+			network.Run()
+		}(network)
+	}
+	wg.Wait()
 
+	snapshotModels()
+	unlockRunning()
 	os.Exit(0)
 }
@@ -0,0 +1,173 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FuzzMessageHandler runs arbitrary messages through MessageHandler in
+// TestMode, checking that nothing panics, that generated answers stay within
+// the word limit and that logs never escape the data directory.
+func FuzzMessageHandler(f *testing.F) {
+	f.Add("bob", "#debsquad", "le chat dort sur le canapé")
+	f.Add("bob", "#debsquad", "paglop: chat")
+	f.Add("bob", "#debsquad", "paglop, seed 42 le chat")
+	f.Add("bob", "#debsquad", "paglop: seed -1")
+	f.Add("bob", "../../etc", "paglop ++")
+	f.Add("", "", "ACTION \x00$ paglop:")
+
+	f.Fuzz(func(t *testing.T, nick, target, body string) {
+		network, output := setupTestBot(t)
+		dir := cfg.MarkovDataPath
+		root := filepath.Dir(dir)
+		network.models.shared.Chain.AddLine("ACTION caresse le chat")
+
+		network.MessageHandler(Speaker{Nick: nick}, target, body, time.Now())
+
+		for _, line := range strings.Split(output.String(), "\n") {
+			if i := strings.Index(line, " :"); i >= 0 {
+				line = line[i+2:]
+			}
+			if count := len(strings.Fields(line)); count > 2*10+2 {
+				t.Fatalf("answer too long (%d words): %q", count, line)
+			}
+		}
+
+		matches, err := filepath.Glob(filepath.Join(root, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range matches {
+			if match != dir {
+				t.Fatalf("log written outside of data dir: %s", match)
+			}
+		}
+	})
+}
+
+// setupTestBot configures a TestMode network learning into a chain logged to
+// a "data" directory, alone in its temporary directory, and returns it along
+// with the buffer receiving its messages.
+func setupTestBot(t *testing.T) (*Network, *bytes.Buffer) {
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0770); err != nil {
+		t.Fatal(err)
+	}
+	cfg = Cfg{
+		TestMode:       true,
+		MarkovDataPath: dir,
+	}
+	secrets = Secrets{}
+	optOuts = &OptOuts{}
+
+	model := &Model{
+		Name:         ModelShared,
+		Files:        DataFiles{Path: dir},
+		SnapshotPath: filepath.Join(dir, "chain.snapshot"),
+		Chain:        NewChainWithSource(2, rand.NewSource(1)),
+	}
+	model.Chain.AddLine("le chat dort sur le canapé")
+
+	network := newNetwork(NetworkCfg{
+		Name:        "test",
+		IRCNickname: "paglop",
+	}, newModelRegistry(model))
+
+	var output bytes.Buffer
+	testModeOutput = &output
+	t.Cleanup(func() { testModeOutput = os.Stdout })
+
+	return network, &output
+}
+
+func TestMessageHandlerPrivateMessage(t *testing.T) {
+	network, output := setupTestBot(t)
+
+	network.MessageHandler(Speaker{Nick: "bob"}, "paglop", "le chat", time.Now())
+	if output.String() != "PRIVMSG bob :le chat dort sur le canapé\n" {
+		t.Fatalf("wrong answer to a private message: %q", output.String())
+	}
+
+	output.Reset()
+	network.MessageHandler(Speaker{Nick: "bob"}, "paglop", "paglop: le chat", time.Now())
+	if !strings.HasPrefix(output.String(), "PRIVMSG bob :") {
+		t.Fatalf("wrong answer to an addressed private message: %q",
+			output.String())
+	}
+
+	if _, err := os.Stat(network.models.shared.getLogFilename("bob")); !os.IsNotExist(err) {
+		t.Fatal("private message logged")
+	}
+	if _, err := os.Stat(network.models.shared.getLogFilename("paglop")); !os.IsNotExist(err) {
+		t.Fatal("private message logged")
+	}
+}
+
+func TestMessageHandlerLearnFromPrivateMessages(t *testing.T) {
+	network, _ := setupTestBot(t)
+	network.config.LearnFromPrivateMessages = true
+
+	network.MessageHandler(Speaker{Nick: "bob"}, "paglop", "le chien dort aussi", time.Now())
+
+	if network.models.shared.Chain.GetScoredWords("chien")[0].Score != 1 {
+		t.Fatal("private message not learned")
+	}
+	if _, err := os.Stat(network.models.shared.getLogFilename("bob")); err != nil {
+		t.Fatal("private message not logged: ", err)
+	}
+}
+
+func TestMessageHandlerLastSeed(t *testing.T) {
+	network, output := setupTestBot(t)
+	for _, line := range []string{
+		"le chat mange la souris",
+		"le chat court après le chien",
+		"le chien dort sur le tapis",
+		"la souris mange le fromage",
+	} {
+		network.models.shared.Chain.AddLine(line)
+	}
+
+	network.MessageHandler(Speaker{Nick: "bob"}, "#debsquad", "paglop: seed?", time.Now())
+	if output.String() != "PRIVMSG #debsquad :je n'ai encore rien dit ici\n" {
+		t.Fatalf("wrong answer without seed: %q", output.String())
+	}
+
+	for i := 0; i < 5; i++ {
+		output.Reset()
+		network.MessageHandler(Speaker{Nick: "bob"}, "#debsquad", "paglop: le chat", time.Now())
+		answer := output.String()
+
+		output.Reset()
+		network.MessageHandler(Speaker{Nick: "alice"}, "#debsquad", "paglop: seed?", time.Now())
+		request := strings.TrimPrefix(strings.TrimSpace(output.String()), "PRIVMSG #debsquad :")
+		if !strings.HasPrefix(request, "seed ") || !strings.HasSuffix(request, " le chat") {
+			t.Fatalf("wrong last seed: %q", request)
+		}
+
+		output.Reset()
+		network.MessageHandler(Speaker{Nick: "carol"}, "#debsquad", "paglop: "+request, time.Now())
+		if output.String() != answer {
+			t.Fatalf("%q not reproduced by %q: %q", answer, request, output.String())
+		}
+	}
+
+	output.Reset()
+	network.MessageHandler(Speaker{Nick: "dave"}, "#DebSquad", "paglop: seed?", time.Now())
+	if !strings.HasPrefix(output.String(), "PRIVMSG #DebSquad :seed ") {
+		t.Fatalf("last seed not found with another casing: %q", output.String())
+	}
+}
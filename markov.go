@@ -43,14 +43,13 @@ package main
 import (
 	"bufio"
 	"io"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
-	"unicode"
 )
 
 type ScoredWord struct {
@@ -64,6 +63,20 @@ func (a ByScore) Len() int           { return len(a) }
 func (a ByScore) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByScore) Less(i, j int) bool { return a[i].Score < a[j].Score }
 
+// Sentinel tokens recorded in the chain where lines begin and end.  They
+// contain a NUL byte, which cannot be part of an IRC message, so they never
+// collide with actual words.
+const (
+	LineStart = "\x00^"
+	LineEnd   = "\x00$"
+)
+
+// IsSentinel returns true if the given token marks the beginning or the end of
+// a line.
+func IsSentinel(word string) bool {
+	return word == LineStart || word == LineEnd
+}
+
 // Leader is a Markov chain prefix of one or more words.
 type Leader []string
 
@@ -84,26 +97,112 @@ func (p Leader) Unshift(word string) {
 	p[0] = word
 }
 
+// Words returns the words of the Leader, without the sentinel tokens.
+func (p Leader) Words() []string {
+	var words []string
+	for _, word := range p {
+		if !IsSentinel(word) {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// Supported range of leader lengths (the order of the Markov chain).  Low
+// orders produce creative (often incoherent) sentences, high orders produce
+// coherent sentences that tend to quote the input verbatim.
+const (
+	MinMarkovOrder = 1
+	MaxMarkovOrder = 5
+)
+
 // Chain contains a map ("chain") of leaders to a list of follower words.
-// A leader is a string of leaderLen words joined with spaces.
-// A follower word is a single word. A leader can have multiple follower words.
+// All the words are interned in a Dictionary, a leader is a Tuple of leaderLen
+// word IDs. A follower word is a single word ID. A leader can have multiple
+// follower words, each of them counted.  The index lists the forward leaders
+// containing each word.
+//
+// A Chain is safe for concurrent use: learning locks the tables for writing,
+// generation locks them for reading.  Exported methods take the lock,
+// unexported methods expect the caller to hold it.
+//
+// The tables are shared with the chains returned by WithSeed, which only
+// differ by their random source.
 type Chain struct {
-	forward   map[string][]string
-	backward  map[string][]string
-	words     map[string]uint64
+	*chainTables
+
+	// rng is shared by all the concurrent readers, it has its own lock.
+	rng      *rand.Rand
+	rngMutex sync.Mutex
+}
+
+// chainTables is the learned part of a Chain.
+type chainTables struct {
+	forward   map[Tuple]Followers
+	backward  map[Tuple]Followers
+	index     map[WordID][]Tuple
+	dict      *Dictionary
 	leaderLen int
+	mutex     sync.RWMutex
+
+	// substringMatch makes topic lookups match any word containing the
+	// requested word instead of the exact word.
+	substringMatch bool
 }
 
-// NewChain returns a new Chain with leaders of leaderLen words.
+// NewChain returns a new Chain with leaders of leaderLen words, using a random
+// source seeded with the current time.
 func NewChain(leaderLen int) *Chain {
+	return NewChainWithSource(leaderLen,
+		rand.NewSource(time.Now().UnixNano()))
+}
+
+// NewChainWithSource returns a new Chain with leaders of leaderLen words, using
+// the given random source for generation.
+func NewChainWithSource(leaderLen int, src rand.Source) *Chain {
+	return &Chain{
+		chainTables: &chainTables{
+			forward:   make(map[Tuple]Followers),
+			backward:  make(map[Tuple]Followers),
+			index:     make(map[WordID][]Tuple),
+			dict:      NewDictionary(),
+			leaderLen: leaderLen,
+		},
+		rng: rand.New(src),
+	}
+}
+
+// SetSource replaces the random source used for generation.
+func (chain *Chain) SetSource(src rand.Source) {
+	chain.rngMutex.Lock()
+	defer chain.rngMutex.Unlock()
+	chain.rng = rand.New(src)
+}
+
+// WithSeed returns a Chain sharing the tables of this chain but generating from
+// its own random source seeded with seed.  Given the same tables, the same
+// calls on chains with the same seed produce the same output.
+func (chain *Chain) WithSeed(seed int64) *Chain {
 	return &Chain{
-		forward:   make(map[string][]string),
-		backward:  make(map[string][]string),
-		words:     make(map[string]uint64),
-		leaderLen: leaderLen,
+		chainTables: chain.chainTables,
+		rng:         rand.New(rand.NewSource(seed)),
 	}
 }
 
+// NewSeed draws a seed from the chain random source, for use with WithSeed.
+func (chain *Chain) NewSeed() int64 {
+	chain.rngMutex.Lock()
+	defer chain.rngMutex.Unlock()
+	return chain.rng.Int63()
+}
+
+// randInt63n returns a random number in [0,n) from the chain random source.
+func (chain *Chain) randInt63n(n int64) int64 {
+	chain.rngMutex.Lock()
+	defer chain.rngMutex.Unlock()
+	return chain.rng.Int63n(n)
+}
+
 // BadLine decides which lines to skip from the input file.
 func BadLine(line string) bool {
 	// Comments
@@ -121,6 +220,11 @@ func BadLine(line string) bool {
 
 // BadWord decide whether we should keep this word.
 func BadWord(word string) bool {
+	// Never let the input forge a sentinel token.
+	if IsSentinel(word) {
+		return true
+	}
+
 	// We don't care for partial quotes.
 	numQuotes := strings.Count(word, `"`)
 	if numQuotes != 0 && numQuotes != 2 {
@@ -138,29 +242,308 @@ func BadWord(word string) bool {
 
 // AddWord adds a new word to the word registry or increase its score.  This
 // registry is used to determine the topic of a sentence.
-func (chain *Chain) AddWord(word string) {
-	chain.words[word] = chain.words[word] + 1
+func (chain *Chain) AddWord(word string) WordID {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	return chain.addWord(word)
 }
 
-// AddLine adds a new line to the markov chain.
+func (chain *Chain) addWord(word string) WordID {
+	id := chain.dict.Intern(word)
+	chain.dict.Counts[id]++
+	return id
+}
+
+// AddLine adds a new line to the markov chain.  A window of leaderLen+1 words
+// slides over the line: its first leaderLen words lead forward to the last
+// one, its last leaderLen words lead backward to the first one.  The line is
+// surrounded by LineStart and LineEnd tokens so generation can stop where
+// actual lines stopped.
 func (chain *Chain) AddLine(line string) {
-	var a, b, c string
+	if BadLine(line) {
+		return
+	}
+
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	var window [MaxMarkovOrder + 1]WordID
+	for i := 0; i <= chain.leaderLen; i++ {
+		window[i] = LineStartID
+	}
+
+	count := 0
+	for _, word := range strings.Fields(line) {
+		if BadWord(word) {
+			continue
+		}
+		chain.addWindow(&window, chain.addWord(word))
+		count++
+	}
 
+	if count > 0 {
+		chain.addWindow(&window, LineEndID)
+	}
+}
+
+// RemoveLine forgets a line previously added to the chain: the counts of its
+// words and transitions are decremented, the transitions and leaders no
+// longer seen are dropped.  The words stay in the dictionary with a zero
+// count until Compact.  Nothing is removed unless all the transitions of the
+// line are found, a line never learned would damage the others.
+func (chain *Chain) RemoveLine(line string) {
 	if BadLine(line) {
 		return
 	}
 
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	var ids []WordID
 	for _, word := range strings.Fields(line) {
 		if BadWord(word) {
 			continue
 		}
-		chain.AddWord(word)
-		a, b, c = b, c, word
-		fKey := a + " " + b
-		bKey := b + " " + c
-		chain.forward[fKey] = append(chain.forward[fKey], c)
-		chain.backward[bKey] = append(chain.backward[bKey], a)
+		id := chain.dict.Lookup(word)
+		if id == NoWord {
+			// A word never learned, neither was the line.
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 || !chain.hasLine(ids) {
+		return
+	}
+
+	var window [MaxMarkovOrder + 1]WordID
+	for i := 0; i <= chain.leaderLen; i++ {
+		window[i] = LineStartID
+	}
+
+	for _, id := range ids {
+		chain.dict.Counts[id]--
+		chain.removeWindow(&window, id)
+	}
+	chain.removeWindow(&window, LineEndID)
+}
+
+// hasLine returns true if the words and the forward transitions of the line
+// made of ids were all seen at least as many times as the line uses them.
+func (chain *Chain) hasLine(ids []WordID) bool {
+	type transition struct {
+		leader Tuple
+		word   WordID
+	}
+	words := make(map[WordID]uint64)
+	transitions := make(map[transition]uint32)
+
+	var window [MaxMarkovOrder + 1]WordID
+	for i := 0; i <= chain.leaderLen; i++ {
+		window[i] = LineStartID
+	}
+
+	n := chain.leaderLen
+	for i := 0; i <= len(ids); i++ {
+		id := LineEndID
+		if i < len(ids) {
+			id = ids[i]
+			words[id]++
+			if chain.dict.Counts[id] < words[id] {
+				return false
+			}
+		}
+
+		copy(window[:n], window[1:n+1])
+		window[n] = id
+		var t transition
+		copy(t.leader[:], window[:n])
+		t.word = id
+
+		transitions[t]++
+		if chain.forward[t.leader].Count(id) < transitions[t] {
+			return false
+		}
 	}
+
+	return true
+}
+
+// removeWindow shifts word into the window and forgets its transitions.
+func (chain *Chain) removeWindow(window *[MaxMarkovOrder + 1]WordID, word WordID) {
+	var fKey, bKey Tuple
+
+	n := chain.leaderLen
+	copy(window[:n], window[1:n+1])
+	window[n] = word
+	copy(fKey[:], window[:n])
+	copy(bKey[:], window[1:n+1])
+
+	if removeFollower(chain.forward, fKey, window[n]) {
+		chain.unindexTuple(fKey)
+	}
+	removeFollower(chain.backward, bKey, window[0])
+}
+
+// unindexTuple removes a forward leader from the index of its words.
+func (chain *Chain) unindexTuple(t Tuple) {
+	for _, id := range t[:chain.leaderLen] {
+		tuples := chain.index[id]
+		for i := range tuples {
+			if tuples[i] == t {
+				tuples = append(tuples[:i], tuples[i+1:]...)
+				break
+			}
+		}
+		if len(tuples) == 0 {
+			delete(chain.index, id)
+		} else {
+			chain.index[id] = tuples
+		}
+	}
+}
+
+// Compact drops the words no longer part of any transition from the
+// dictionary, e.g. after RemoveLine, and renumbers the others.  The words
+// keep their relative order so the followers stay sorted.
+func (chain *Chain) Compact() {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	used := make([]bool, len(chain.dict.Words))
+	for id := NoWord; id <= LineEndID; id++ {
+		used[id] = true
+	}
+	for _, table := range []map[Tuple]Followers{chain.forward, chain.backward} {
+		for leader, followers := range table {
+			for _, id := range leader[:chain.leaderLen] {
+				used[id] = true
+			}
+			for _, follower := range followers {
+				used[follower.Word] = true
+			}
+		}
+	}
+
+	ids := make([]WordID, len(used))
+	dict := &Dictionary{}
+	for id, ok := range used {
+		if ok {
+			ids[id] = WordID(len(dict.Words))
+			dict.Words = append(dict.Words, chain.dict.Words[id])
+			dict.Counts = append(dict.Counts, chain.dict.Counts[id])
+		}
+	}
+	if len(dict.Words) == len(chain.dict.Words) {
+		return
+	}
+	dict.rebuildIndex()
+
+	remap := func(t Tuple) Tuple {
+		for i := 0; i < chain.leaderLen; i++ {
+			t[i] = ids[t[i]]
+		}
+		return t
+	}
+	remapTable := func(table map[Tuple]Followers) map[Tuple]Followers {
+		remapped := make(map[Tuple]Followers, len(table))
+		for leader, followers := range table {
+			for i := range followers {
+				followers[i].Word = ids[followers[i].Word]
+			}
+			remapped[remap(leader)] = followers
+		}
+		return remapped
+	}
+
+	index := make(map[WordID][]Tuple, len(chain.index))
+	for id, tuples := range chain.index {
+		for i := range tuples {
+			tuples[i] = remap(tuples[i])
+		}
+		index[ids[id]] = tuples
+	}
+
+	chain.forward = remapTable(chain.forward)
+	chain.backward = remapTable(chain.backward)
+	chain.index = index
+	chain.dict = dict
+}
+
+// LineCount returns the number of lines learned by the chain.
+func (chain *Chain) LineCount() uint64 {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+
+	// Every line starts with the leader made of LineStart tokens only.
+	var start Tuple
+	for i := 0; i < chain.leaderLen; i++ {
+		start[i] = LineStartID
+	}
+
+	return chain.forward[start].Total()
+}
+
+// addWindow shifts word into the window and records its transitions.
+func (chain *Chain) addWindow(window *[MaxMarkovOrder + 1]WordID, word WordID) {
+	var fKey, bKey Tuple
+
+	n := chain.leaderLen
+	copy(window[:n], window[1:n+1])
+	window[n] = word
+	copy(fKey[:], window[:n])
+	copy(bKey[:], window[1:n+1])
+
+	if _, ok := chain.forward[fKey]; !ok {
+		chain.indexTuple(fKey)
+	}
+
+	addFollower(chain.forward, fKey, window[n])
+	addFollower(chain.backward, bKey, window[0])
+}
+
+// indexTuple registers a new forward leader under each of its words.
+func (chain *Chain) indexTuple(t Tuple) {
+	leader := t[:chain.leaderLen]
+	for i, id := range leader {
+		if IsSentinelID(id) {
+			continue
+		}
+		// Words repeated in the leader are only indexed once.
+		seen := false
+		for _, prev := range leader[:i] {
+			if prev == id {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			chain.index[id] = append(chain.index[id], t)
+		}
+	}
+}
+
+// addFollower records an occurrence of word after leader in the given table.
+func addFollower(table map[Tuple]Followers, leader Tuple, word WordID) {
+	followers := table[leader]
+	followers.Add(word)
+	table[leader] = followers
+}
+
+// removeFollower forgets an occurrence of word after leader in the given
+// table, it returns true if the leader was dropped from the table.
+func removeFollower(table map[Tuple]Followers, leader Tuple, word WordID) bool {
+	followers, ok := table[leader]
+	if !ok {
+		return false
+	}
+
+	followers.Remove(word)
+	if len(followers) == 0 {
+		delete(table, leader)
+		return true
+	}
+	table[leader] = followers
+	return false
 }
 
 // Build reads text from the provided Reader and
@@ -177,37 +560,74 @@ func (chain *Chain) Build(r io.Reader) {
 	}
 }
 
+// SetSubstringMatch defines whether topic lookups match words containing the
+// requested word (e.g. "chat" matching "chaton") or only the exact word.
+func (chain *Chain) SetSubstringMatch(enabled bool) {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	chain.substringMatch = enabled
+}
+
 // GetRandomTupleForWord will return a tuple from the loaded Markov chain given
-// a single word.
+// a single word.  If the word is unknown, it is returned as-is.
 func (chain *Chain) GetRandomTupleForWord(word string) string {
-	var tuples []string
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+	return chain.getRandomTuple(word, chain.substringMatch)
+}
 
-	for t := range chain.forward {
-		// Avoid any single word tuples.
-		if strings.TrimSpace(t) == word {
-			continue
-		}
-		if strings.Contains(t, word) {
-			tuples = append(tuples, t)
+// GetRandomTupleMatching returns a tuple containing the given word.  If
+// substring is true, the tuple may contain any word containing the given word
+// instead, which requires a scan of the whole dictionary.
+func (chain *Chain) GetRandomTupleMatching(word string, substring bool) string {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+	return chain.getRandomTuple(word, substring)
+}
+
+func (chain *Chain) getRandomTuple(word string, substring bool) string {
+	var tuples []Tuple
+
+	if !substring {
+		tuples = chain.index[chain.dict.Lookup(word)]
+	} else {
+		seen := make(map[Tuple]bool)
+		for id, w := range chain.dict.Words {
+			if IsSentinelID(WordID(id)) || !strings.Contains(w, word) {
+				continue
+			}
+			for _, t := range chain.index[WordID(id)] {
+				if !seen[t] {
+					seen[t] = true
+					tuples = append(tuples, t)
+				}
+			}
 		}
 	}
 
 	if len(tuples) == 0 {
 		return word
 	} else if len(tuples) == 1 {
-		return tuples[0]
+		return chain.leader(tuples[0]).String()
 	}
 
-	return tuples[rand.Intn(len(tuples))]
+	i := chain.randInt63n(int64(len(tuples)))
+	return chain.leader(tuples[i]).String()
 }
 
 // GetScoredWords returns a list of the words in the given sentence along with
 // their popularity score from the markov chain data.
 func (chain *Chain) GetScoredWords(sentence string) []ScoredWord {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+	return chain.getScoredWords(sentence)
+}
+
+func (chain *Chain) getScoredWords(sentence string) []ScoredWord {
 	var words []ScoredWord
 
 	for _, word := range strings.Fields(sentence) {
-		score := chain.words[word]
+		score := chain.dict.Count(word)
 		words = append(words, ScoredWord{word, score})
 	}
 
@@ -217,65 +637,98 @@ func (chain *Chain) GetScoredWords(sentence string) []ScoredWord {
 // GetWordsByPopularity returns a list of the words in this sentence sorted by
 // popularity.  Small words are filtered out.
 func (chain *Chain) GetWordsByPopularity(sentence string) []string {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+	return chain.getWordsByPopularity(sentence)
+}
+
+func (chain *Chain) getWordsByPopularity(sentence string) []string {
 	var words []string
-	scoredWords := chain.GetScoredWords(sentence)
-	sort.Sort(ByScore(scoredWords))
+	scoredWords := chain.getScoredWords(sentence)
+	sort.Stable(ByScore(scoredWords))
 	for _, sw := range scoredWords {
 		words = append(words, sw.Word)
 	}
 	return words
 }
 
-// GenerateCore returns a list of at most n words generated from Chain.
-func (chain *Chain) GenerateCore(forward bool, start string, n int) []string {
+// NewLeader converts a string to a Leader of leaderLen words.  Longer strings
+// are truncated to their last words, shorter strings are padded at the front
+// with LineStart tokens.
+func (chain *Chain) NewLeader(s string) Leader {
+	n := chain.leaderLen
+	p := make(Leader, n)
+	for i := range p {
+		p[i] = LineStart
+	}
+	if s == "" {
+		return p
+	}
+
+	words := strings.Fields(s)
+	if len(words) > n {
+		words = words[len(words)-n:]
+	}
+	copy(p[n-len(words):], words)
+
+	return p
+}
+
+// tuple converts a Leader to a Tuple, words unknown to the chain are mapped to
+// NoWord.
+func (chain *Chain) tuple(p Leader) Tuple {
+	var t Tuple
+	for i, word := range p {
+		t[i] = chain.dict.Lookup(word)
+	}
+	return t
+}
+
+// leader converts a Tuple back to a Leader.
+func (chain *Chain) leader(t Tuple) Leader {
 	p := make(Leader, chain.leaderLen)
-	if start != "" {
-		p = strings.Fields(start)
+	for i := range p {
+		p[i] = chain.dict.Word(t[i])
 	}
-	var words []string
-	words = append(words, p...)
+	return p
+}
+
+// GenerateCore returns a list of at most n words generated from Chain.
+func (chain *Chain) GenerateCore(forward bool, start string, n int) []string {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+	return chain.generateCore(forward, start, n)
+}
+
+func (chain *Chain) generateCore(forward bool, start string, n int) []string {
+	p := chain.NewLeader(start)
+	words := p.Words()
+	t := chain.tuple(p)
 	for i := 0; i < n; i++ {
-		var choices []string
+		var choices Followers
 		if forward {
-			choices = chain.forward[p.String()]
+			choices = chain.forward[t]
 		} else {
-			choices = chain.backward[p.String()]
+			choices = chain.backward[t]
 		}
 		if len(choices) == 0 {
 			break
 		}
 
-		next := choices[rand.Intn(len(choices))]
+		next := choices.Pick(uint64(chain.randInt63n(int64(choices.Total()))))
 
-		if forward {
-			p.Shift(next)
-		} else {
-			// This is the code for "Beginning of sentence.
-			if next == " " || next == "" {
-				break
-			}
-			p.Unshift(next)
+		// Stop where an actual line stopped.
+		if IsSentinelID(next) {
+			break
 		}
 
+		word := chain.dict.Word(next)
 		if forward {
-			words = append(words, next)
+			t.Shift(chain.leaderLen, next)
+			words = append(words, word)
 		} else {
-			words = append([]string{next}, words...)
-		}
-
-		// We have at least 15 words and we have a period, let's stop.
-		if len(words) > 6 {
-			if forward {
-				lastchr := next[len(next)-1]
-				if lastchr == '.' || lastchr == '!' || lastchr == '?' {
-					break
-				}
-			} else {
-				firstchr := ([]rune(next))[0]
-				if unicode.IsUpper(firstchr) {
-					break
-				}
-			}
+			t.Unshift(chain.leaderLen, next)
+			words = append([]string{word}, words...)
 		}
 	}
 
@@ -291,13 +744,22 @@ func (chain *Chain) Generate(n int) string {
 // GenerateFromWord returns a string of at most 2*n words generated from the
 // Markov chain using the given word as base.
 func (chain *Chain) GenerateFromWord(n int, word string) string {
-	tuple := chain.GetRandomTupleForWord(word)
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+	return chain.generateFromWord(n, word)
+}
+
+func (chain *Chain) generateFromWord(n int, word string) string {
+	tuple := chain.getRandomTuple(word, chain.substringMatch)
 	log.Printf("Chosen tuple: %s", tuple)
 
-	bwords := chain.GenerateCore(false, tuple, n)
-	fwords := chain.GenerateCore(true, tuple, n)
-	if len(fwords) > 2 {
-		fwords = fwords[2:]
+	bwords := chain.generateCore(false, tuple, n)
+	fwords := chain.generateCore(true, tuple, n)
+
+	// Both halves contain the tuple itself, only keep it once.
+	tupleLen := len(chain.NewLeader(tuple).Words())
+	if len(fwords) > tupleLen {
+		fwords = fwords[tupleLen:]
 	} else {
 		fwords = nil
 	}
@@ -311,13 +773,16 @@ func (chain *Chain) GenerateFromWord(n int, word string) string {
 // GenerateOnTopic returns a string of at most n words generated from Chain
 // using the least common word in the provided sentence.
 func (chain *Chain) GenerateOnTopic(n int, sentence string) string {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+
 	var newSentence string
-	words := chain.GetWordsByPopularity(sentence)
+	words := chain.getWordsByPopularity(sentence)
 
 	for _, w := range words {
 		log.Printf("Chosen word: %s", w)
 
-		newSentence = chain.GenerateFromWord(n, w)
+		newSentence = chain.generateFromWord(n, w)
 		spaceCount := strings.Count(newSentence, " ")
 
 		if newSentence != sentence && spaceCount > 0 {
@@ -352,28 +817,34 @@ func (chain *Chain) GenerateBackward(end string, n int) string {
 	return strings.Join(words, " ")
 }
 
-func initializeMarkovChain(path string) *Chain {
-	rand.Seed(time.Now().UnixNano())
+// initializeMarkovChain restores the chain from its snapshot, or builds it
+// from the data files.
+func initializeMarkovChain(files DataFiles, snapshotPath string, order int) *Chain {
+	chain, err := loadSnapshot(snapshotPath, files, order)
+	if err == nil {
+		log.Printf("markov chain restored from %s", snapshotPath)
+		return chain
+	}
+	if !os.IsNotExist(err) {
+		log.Printf("unable to restore %s (%s), rebuilding", snapshotPath,
+			err.Error())
+	}
 
-	fileInfos, err := ioutil.ReadDir(path)
+	fileInfos, err := files.List()
 	if err != nil {
 		println("initializeMarkovChain ReadDir: " + err.Error())
 		os.Exit(1)
 	}
 
-	chain := NewChain(2)
+	chain = NewChain(order)
 
 	for _, fileInfo := range fileInfos {
-		filename := fileInfo.Name()
-		if !strings.HasSuffix(filename, ".txt") {
-			continue
-		}
-		file, err := os.Open(path + "/" + filename)
+		file, err := os.Open(files.Path + "/" + fileInfo.Name())
 		if err != nil {
 			println("initializeMarkovChain Open: " + err.Error())
 			os.Exit(1)
 		}
-		chain.Build(file)
+		buildDataFile(chain, file, fileInfo.Name())
 		file.Close()
 	}
 
@@ -5,6 +5,18 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -13,11 +25,11 @@ func TestGetReversedArrayThree(t *testing.T) {
 	output := getReversedArray(input)
 
 	if len(output) != len(input) {
-		t.Fatal("wrong length (%d)", len(output))
+		t.Fatalf("wrong length (%d)", len(output))
 	}
 
 	if output[0] != "c" || output[1] != "b" || output[2] != "a" {
-		t.Fatal("not reversed: %s", output)
+		t.Fatalf("not reversed: %s", output)
 	}
 }
 
@@ -26,11 +38,11 @@ func TestGetReversedArrayOne(t *testing.T) {
 	output := getReversedArray(input)
 
 	if len(output) != len(input) {
-		t.Fatal("wrong length (%d)", len(output))
+		t.Fatalf("wrong length (%d)", len(output))
 	}
 
 	if output[0] != "a" {
-		t.Fatal("not reversed: %s", output)
+		t.Fatalf("not reversed: %s", output)
 	}
 }
 
@@ -43,10 +55,375 @@ func TestLeaderUnshift(t *testing.T) {
 	input.Unshift("Z")
 
 	if len(input) != 3 {
-		t.Fatal("wrong length (%d)", len(input))
+		t.Fatalf("wrong length (%d)", len(input))
 	}
 
 	if input[0] != "Z" || input[1] != "a" || input[2] != "b" {
-		t.Fatal("not unshifted: %s", input)
+		t.Fatalf("not unshifted: %s", input)
 	}
 }
+
+func TestChainOrders(t *testing.T) {
+	line := "the quick brown fox jumps over lazy dogs"
+
+	for order := MinMarkovOrder; order <= MaxMarkovOrder; order++ {
+		chain := NewChain(order)
+		chain.AddLine(line)
+
+		if output := chain.Generate(20); output != line {
+			t.Fatalf("order %d: wrong forward output: %q", order, output)
+		}
+
+		words := strings.Fields(line)
+		end := strings.Join(words[len(words)-order:], " ")
+		if output := chain.GenerateBackward(end, 20); output != line {
+			t.Fatalf("order %d: wrong backward output: %q", order, output)
+		}
+
+		if output := chain.GenerateFromWord(20, "fox"); output != line {
+			t.Fatalf("order %d: wrong output from word: %q", order, output)
+		}
+	}
+}
+
+func TestChainStopsAtLineBoundaries(t *testing.T) {
+	chain := NewChain(2)
+	chain.AddLine("lol ok then see you later")
+	chain.AddLine("nope not today my friend")
+
+	if output := chain.GenerateForward("ok then", 50); output != "ok then see you later" {
+		t.Fatalf("forward generation did not stop at the end: %q", output)
+	}
+
+	if output := chain.GenerateBackward("not today", 50); output != "nope not today" {
+		t.Fatalf("backward generation did not stop at the start: %q", output)
+	}
+}
+
+func TestChainRemoveLine(t *testing.T) {
+	for order := MinMarkovOrder; order <= MaxMarkovOrder; order++ {
+		expected := NewChain(order)
+		expected.AddLine("le chat dort sur le canapé")
+		expected.AddLine("le chat dort")
+
+		chain := NewChain(order)
+		chain.AddLine("le chat dort sur le canapé")
+		chain.AddLine("le chat dort")
+		chain.AddLine("le chien dort sur le tapis du chat")
+		chain.RemoveLine("le chien dort sur le tapis du chat")
+		chain.RemoveLine("le hibou ne dort pas")
+
+		// Made of learned words and starting like learned lines, but
+		// never learned itself.
+		chain.RemoveLine("le chat dort sur le tapis")
+		chain.RemoveLine("le chat dort dort")
+
+		if !reflect.DeepEqual(chain.forward, expected.forward) ||
+			!reflect.DeepEqual(chain.backward, expected.backward) ||
+			!reflect.DeepEqual(chain.index, expected.index) {
+			t.Fatalf("order %d: transitions not removed", order)
+		}
+
+		for _, word := range []string{"le", "chat", "chien", "tapis"} {
+			if chain.dict.Count(word) != expected.dict.Count(word) {
+				t.Fatalf("order %d: wrong count for %s: %d", order,
+					word, chain.dict.Count(word))
+			}
+		}
+
+		if tuple := chain.GetRandomTupleForWord("tapis"); tuple != "tapis" {
+			t.Fatalf("order %d: forgotten word still indexed: %q",
+				order, tuple)
+		}
+
+		// Compacted, nothing is left of the forgotten line.
+		chain.Compact()
+		if !reflect.DeepEqual(chain.forward, expected.forward) ||
+			!reflect.DeepEqual(chain.backward, expected.backward) ||
+			!reflect.DeepEqual(chain.index, expected.index) ||
+			!reflect.DeepEqual(chain.dict.Words, expected.dict.Words) ||
+			!reflect.DeepEqual(chain.dict.Counts, expected.dict.Counts) {
+			t.Fatalf("order %d: words not compacted: %v", order,
+				chain.dict.Words)
+		}
+		if chain.dict.Lookup("tapis") != NoWord {
+			t.Fatalf("order %d: forgotten word still interned", order)
+		}
+	}
+}
+
+func TestGetRandomTupleForWordExact(t *testing.T) {
+	chain := NewChain(2)
+	chain.AddLine("le chaton dort encore")
+
+	if tuple := chain.GetRandomTupleForWord("chat"); tuple != "chat" {
+		t.Fatalf("exact lookup matched a longer word: %q", tuple)
+	}
+
+	tuple := chain.GetRandomTupleMatching("chat", true)
+	if !strings.Contains(tuple, "chaton") {
+		t.Fatalf("substring lookup did not match: %q", tuple)
+	}
+
+	for i := 0; i < 10; i++ {
+		tuple := chain.GetRandomTupleForWord("dort")
+		if tuple != "chaton dort" && tuple != "dort encore" {
+			t.Fatalf("wrong tuple for dort: %q", tuple)
+		}
+	}
+}
+
+// TestChainConcurrent hammers a chain with concurrent learning and generation,
+// it is mostly useful with the race detector (go test -race).
+func TestChainConcurrent(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	chain := NewChain(2)
+	chain.AddLine("the cat sat on the mat")
+
+	lines := []string{
+		"the dog sat on the cat",
+		"a cat is not a dog",
+		"on the mat there is a hat",
+		"the hat is on the dog",
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				chain.AddLine(lines[(i+j)%len(lines)])
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				chain.GenerateOnTopic(10, "what about the cat")
+				chain.Generate(10)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 20; j++ {
+			chain.WriteSnapshot(ioutil.Discard, nil)
+		}
+	}()
+
+	wg.Wait()
+
+	if count := chain.GetScoredWords("cat")[0].Score; count != 1+1000 {
+		t.Fatalf("lost updates: cat=%d", count)
+	}
+}
+
+func TestChainWithSeedIsReproducible(t *testing.T) {
+	chain := NewChainWithSource(2, rand.NewSource(1))
+	for _, line := range []string{
+		"the cat sat on the mat",
+		"the dog sat on the cat",
+		"a cat is not a dog",
+		"on the mat there is a hat",
+		"the hat is on the dog",
+	} {
+		chain.AddLine(line)
+	}
+
+	for seed := int64(0); seed < 20; seed++ {
+		first := chain.WithSeed(seed).GenerateOnTopic(10, "the cat")
+		second := chain.WithSeed(seed).GenerateOnTopic(10, "the cat")
+		if first != second {
+			t.Fatalf("seed %d: %q != %q", seed, first, second)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// goldenSeed is the seed used for all the golden generation tests.
+const goldenSeed = 42
+
+// newGoldenChain returns a chain built from the fixed golden corpus.
+func newGoldenChain(t *testing.T) *Chain {
+	file, err := os.Open(filepath.Join("testdata", "corpus.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	chain := NewChainWithSource(2, rand.NewSource(goldenSeed))
+	chain.Build(file)
+
+	return chain
+}
+
+// dumpChain returns a sorted, human readable listing of the chain tables.
+func dumpChain(chain *Chain) string {
+	var lines []string
+
+	dumpTable := func(name string, table map[Tuple]Followers) {
+		for t, followers := range table {
+			var words []string
+			for _, f := range followers {
+				words = append(words, fmt.Sprintf("%q:%d",
+					chain.dict.Word(f.Word), f.Count))
+			}
+			lines = append(lines, fmt.Sprintf("%s %q -> %s", name,
+				chain.leader(t).String(), strings.Join(words, " ")))
+		}
+	}
+	dumpTable("forward", chain.forward)
+	dumpTable("backward", chain.backward)
+
+	for id, word := range chain.dict.Words {
+		if WordID(id) > LineEndID {
+			lines = append(lines, fmt.Sprintf("word %q %d", word,
+				chain.dict.Counts[id]))
+		}
+	}
+
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// checkGolden compares output with the content of testdata/golden/name.golden,
+// or updates the file if the -update flag is set.
+func checkGolden(t *testing.T, name, output string) {
+	filename := filepath.Join("testdata", "golden", name+".golden")
+
+	if *update {
+		err := ioutil.WriteFile(filename, []byte(output), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("%s (run go test -update to create it)", err)
+	}
+
+	if string(expected) != output {
+		t.Errorf("%s: output differs from golden file (run go test "+
+			"-update and review the diff)\n--- expected\n%s--- got\n%s",
+			name, expected, output)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	chain := newGoldenChain(t)
+	inputs := []string{"chat", "café", "serveur", "le chat", "bonjour",
+		"cat", "inconnu"}
+	leaders := []string{"le chat", "un café", "le serveur", "the cat",
+		"nope nope"}
+
+	tests := []struct {
+		name     string
+		generate func(chain *Chain, input string) string
+		inputs   []string
+	}{
+		{"GenerateFromWord", func(chain *Chain, input string) string {
+			return chain.GenerateFromWord(10, input)
+		}, inputs},
+		{"GenerateOnTopic", func(chain *Chain, input string) string {
+			return chain.GenerateOnTopic(10, input)
+		}, inputs},
+		{"GenerateForward", func(chain *Chain, input string) string {
+			return chain.GenerateForward(input, 10)
+		}, leaders},
+		{"GenerateBackward", func(chain *Chain, input string) string {
+			return chain.GenerateBackward(input, 10)
+		}, leaders},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var output string
+			for _, input := range test.inputs {
+				seeded := chain.WithSeed(goldenSeed)
+				output += fmt.Sprintf("%q -> %q\n", input,
+					test.generate(seeded, input))
+			}
+			checkGolden(t, test.name, output)
+		})
+	}
+
+	t.Run("AddLine", func(t *testing.T) {
+		checkGolden(t, "AddLine", dumpChain(chain))
+	})
+}
+
+func TestGoldenFilters(t *testing.T) {
+	lines := []string{"", "ok", "lol", "# comment", "salut", "salut tout",
+		"  ", "#channel is great"}
+	words := []string{"chat", `"bonjour"`, `"bonjour`, `bonjour"`,
+		"(encore)", "(encore", "encore)", "()", `""`, "(a)b", ":)"}
+
+	var output string
+	for _, line := range lines {
+		output += fmt.Sprintf("BadLine(%q) = %v\n", line, BadLine(line))
+	}
+	checkGolden(t, "BadLine", output)
+
+	output = ""
+	for _, word := range words {
+		output += fmt.Sprintf("BadWord(%q) = %v\n", word, BadWord(word))
+	}
+	checkGolden(t, "BadWord", output)
+}
+
+// FuzzChain runs arbitrary lines through the whole learning and generation
+// pipeline, checking that nothing panics and that generation stays within its
+// word limit.
+func FuzzChain(f *testing.F) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	f.Add("le chat dort sur le canapé", "chat", 2)
+	f.Add(`il a dit "bonjour (encore`, "(encore", 3)
+	f.Add("\x00^ \x00$ \x00^", "\x00$", 1)
+	f.Add("ACTION é\xff\xfe (", "\xff", 5)
+	f.Add("", "", 4)
+	f.Add("le chat", "chat", math.MinInt64)
+
+	f.Fuzz(func(t *testing.T, line, topic string, order int) {
+		if order < MinMarkovOrder || order > MaxMarkovOrder {
+			order = MinMarkovOrder +
+				((order%MaxMarkovOrder)+MaxMarkovOrder)%MaxMarkovOrder
+		}
+
+		chain := NewChainWithSource(order, rand.NewSource(1))
+		chain.AddLine(line)
+		chain.AddLine(line + " " + topic)
+
+		const limit = 10
+		maxWords := 2*limit + order
+		for _, output := range []string{
+			chain.GenerateOnTopic(limit, topic),
+			chain.GenerateOnTopic(limit, line),
+			chain.GenerateForward(topic, limit),
+			chain.GenerateBackward(topic, limit),
+			chain.Generate(limit),
+		} {
+			if count := len(strings.Fields(output)); count > maxWords {
+				t.Fatalf("generated %d words (limit %d): %q",
+					count, maxWords, output)
+			}
+			for _, word := range strings.Fields(output) {
+				if IsSentinel(word) {
+					t.Fatalf("sentinel leaked in output: %q",
+						output)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrEmptyMessage is returned when parsing a line without command.
+var ErrEmptyMessage = errors.New("empty IRC message")
+
+// Message is a line received from the IRC server (RFC 1459 section 2.3.1),
+// optionally starting with IRCv3 message tags:
+//
+//	@time=2015-01-01T00:00:00.000Z;account=nick :nick!user@host COMMAND param1 param2 :trailing parameter
+type Message struct {
+	Tags    map[string]string
+	Prefix  string
+	Nick    string
+	User    string
+	Host    string
+	Command string
+	Params  []string
+}
+
+// ParseMessage parses a raw IRC line into a Message.
+func ParseMessage(line string) (*Message, error) {
+	msg := &Message{}
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "@") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return nil, ErrEmptyMessage
+		}
+		msg.Tags = parseTags(line[1:i])
+		line = strings.TrimLeft(line[i+1:], " ")
+	}
+
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return nil, ErrEmptyMessage
+		}
+		msg.Prefix = line[1:i]
+		line = line[i+1:]
+		msg.parsePrefix()
+	}
+
+	line = strings.TrimLeft(line, " ")
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		i = len(line)
+	}
+	msg.Command = strings.ToUpper(line[:i])
+	line = line[i:]
+	if msg.Command == "" {
+		return nil, ErrEmptyMessage
+	}
+
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if line[0] == ':' {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			i = len(line)
+		}
+		msg.Params = append(msg.Params, line[:i])
+		line = line[i:]
+	}
+
+	return msg, nil
+}
+
+// tagValueReplacer unescapes the values of message tags.
+var tagValueReplacer = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`,
+	`\r`, "\r", `\n`, "\n", `\`, "")
+
+// parseTags parses the "key=value;key2" tags of a message, without the
+// leading "@".
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			key, value = tag[:i], tagValueReplacer.Replace(tag[i+1:])
+		}
+		tags[key] = value
+	}
+	return tags
+}
+
+// parsePrefix splits a nick!user@host prefix, server prefixes only have a
+// host.
+func (msg *Message) parsePrefix() {
+	prefix := msg.Prefix
+
+	if i := strings.IndexByte(prefix, '@'); i >= 0 {
+		msg.Host = prefix[i+1:]
+		prefix = prefix[:i]
+	} else if !strings.ContainsRune(prefix, '!') {
+		if strings.ContainsRune(prefix, '.') {
+			msg.Host = prefix
+			return
+		}
+	}
+
+	if i := strings.IndexByte(prefix, '!'); i >= 0 {
+		msg.User = prefix[i+1:]
+		prefix = prefix[:i]
+	}
+
+	msg.Nick = prefix
+}
+
+// Param returns the i-th parameter or an empty string.
+func (msg *Message) Param(i int) string {
+	if i < 0 || i >= len(msg.Params) {
+		return ""
+	}
+	return msg.Params[i]
+}
+
+// Trailing returns the last parameter, usually the text of the message.
+func (msg *Message) Trailing() string {
+	return msg.Param(len(msg.Params) - 1)
+}
+
+// Speaker returns the author of the message, along with their services
+// account if the server sent it (account-tag).
+func (msg *Message) Speaker() Speaker {
+	return Speaker{
+		Nick:    msg.Nick,
+		User:    msg.User,
+		Host:    msg.Host,
+		Account: tagAccount(msg.Tags),
+	}
+}
+
+// Time returns when the server received the message (server-time), or now.
+func (msg *Message) Time() time.Time {
+	return tagTime(msg.Tags)
+}
+
+// tagAccount returns the account from the account tag, "*" means the speaker
+// is not logged in.
+func tagAccount(tags map[string]string) string {
+	if account := tags["account"]; account != "*" {
+		return account
+	}
+	return ""
+}
+
+// tagTime returns the time from the server-time tag, or now if missing or
+// invalid.
+func tagTime(tags map[string]string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, tags["time"]); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// parseCTCP returns the command and argument of a CTCP message (e.g.
+// "\x01ACTION waves\x01"), ok is false if body is not a CTCP message.
+func parseCTCP(body string) (command, argument string, ok bool) {
+	if len(body) < 2 || body[0] != '\x01' {
+		return "", "", false
+	}
+
+	body = strings.TrimSuffix(body[1:], "\x01")
+	if i := strings.IndexByte(body, ' '); i >= 0 {
+		return body[:i], body[i+1:], true
+	}
+
+	return body, "", true
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected Message
+	}{
+		{"PING :irc.example.org", Message{
+			Command: "PING",
+			Params:  []string{"irc.example.org"},
+		}},
+		{":irc.example.org 001 paglop :Welcome to IRC\r\n", Message{
+			Prefix:  "irc.example.org",
+			Host:    "irc.example.org",
+			Command: "001",
+			Params:  []string{"paglop", "Welcome to IRC"},
+		}},
+		{":bob!~bob@example.org PRIVMSG #debsquad :paglop: salut", Message{
+			Prefix:  "bob!~bob@example.org",
+			Nick:    "bob",
+			User:    "~bob",
+			Host:    "example.org",
+			Command: "PRIVMSG",
+			Params:  []string{"#debsquad", "paglop: salut"},
+		}},
+		{":bob NICK  bobby", Message{
+			Prefix:  "bob",
+			Nick:    "bob",
+			Command: "NICK",
+			Params:  []string{"bobby"},
+		}},
+		{":srv 433 * paglop :Nickname is already in use", Message{
+			Prefix:  "srv",
+			Nick:    "srv",
+			Command: "433",
+			Params:  []string{"*", "paglop", "Nickname is already in use"},
+		}},
+		{"privmsg #a ::)", Message{
+			Command: "PRIVMSG",
+			Params:  []string{"#a", ":)"},
+		}},
+		{"@time=2015-02-03T04:05:06.789Z;account=bob;+draft/x :bob!~bob@example.org PRIVMSG #a :salut", Message{
+			Tags: map[string]string{
+				"time":     "2015-02-03T04:05:06.789Z",
+				"account":  "bob",
+				"+draft/x": "",
+			},
+			Prefix:  "bob!~bob@example.org",
+			Nick:    "bob",
+			User:    "~bob",
+			Host:    "example.org",
+			Command: "PRIVMSG",
+			Params:  []string{"#a", "salut"},
+		}},
+		{`@msg=a\sb\:c\\d\ne\x;k= CAP * LS :sasl`, Message{
+			Tags: map[string]string{
+				"msg": "a b;c\\d\nex",
+				"k":   "",
+			},
+			Command: "CAP",
+			Params:  []string{"*", "LS", "sasl"},
+		}},
+	}
+
+	for _, test := range tests {
+		msg, err := ParseMessage(test.line)
+		if err != nil {
+			t.Errorf("%q: %s", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(*msg, test.expected) {
+			t.Errorf("%q: got %+v", test.line, *msg)
+		}
+	}
+}
+
+func TestMessageTags(t *testing.T) {
+	msg, err := ParseMessage("@time=2015-02-03T04:05:06.789Z;account=bob :bob!~bob@example.org PRIVMSG #a :salut")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := time.Date(2015, 2, 3, 4, 5, 6, 789000000, time.UTC)
+	if !msg.Time().Equal(expected) {
+		t.Fatalf("wrong server time: %s", msg.Time())
+	}
+	if msg.Speaker().Account != "bob" {
+		t.Fatalf("wrong account: %q", msg.Speaker().Account)
+	}
+
+	msg, err = ParseMessage("@account=* :bob!~bob@example.org PRIVMSG #a :salut")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Speaker().Account != "" {
+		t.Fatalf("logged out speaker has an account: %q",
+			msg.Speaker().Account)
+	}
+	if time.Since(msg.Time()) > time.Minute {
+		t.Fatalf("message without server-time is not recent: %s",
+			msg.Time())
+	}
+}
+
+func TestParseMessageInvalid(t *testing.T) {
+	for _, line := range []string{"", ":prefix-only", "  \r\n", "@tags-only"} {
+		if _, err := ParseMessage(line); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestParseCTCP(t *testing.T) {
+	command, argument, ok := parseCTCP("\x01ACTION waves hello\x01")
+	if !ok || command != "ACTION" || argument != "waves hello" {
+		t.Fatalf("wrong CTCP: %q %q %v", command, argument, ok)
+	}
+
+	command, _, ok = parseCTCP("\x01VERSION\x01")
+	if !ok || command != "VERSION" {
+		t.Fatalf("wrong CTCP: %q %v", command, ok)
+	}
+
+	if _, _, ok := parseCTCP("hello"); ok {
+		t.Fatal("regular message parsed as CTCP")
+	}
+}
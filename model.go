@@ -0,0 +1,543 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// models are all the markov models loaded, they are saved together.
+	models      []*Model
+	modelsMutex sync.Mutex
+
+	// logFilenameReplacer makes sure a channel name cannot escape the
+	// data directory.
+	logFilenameReplacer = strings.NewReplacer("/", "_", "\\", "_",
+		"\x00", "_")
+
+	// logLineReplacer keeps a logged message on a single line.
+	logLineReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+)
+
+// Model is a markov chain along with the data files it is built from, where
+// the lines it learns are logged.
+type Model struct {
+	Name         string
+	Files        DataFiles
+	SnapshotPath string
+	Chain        *Chain
+
+	// SpeakersPath is the directory where the records of every speaker
+	// are also logged apart, empty unless enabled by SpeakerModels.  The
+	// chains of the speakers are loaded on demand, see Speaker.
+	SpeakersPath string
+	speakers     map[string]*Chain
+
+	// mutex serializes learning (including the logging of the line) and
+	// snapshotting so the recorded file offsets always match the content
+	// of the chain.
+	mutex sync.Mutex
+
+	// forgetMutex serializes the rewrites of the logs, see Forget.
+	forgetMutex sync.Mutex
+}
+
+// loadModel restores the model from its snapshot or builds it from the data
+// files, and registers it for the snapshots.
+func loadModel(name string, files DataFiles, snapshotPath string) *Model {
+	if err := os.MkdirAll(files.Path, 0770); err != nil {
+		log.Fatalf("model %s: %s", name, err.Error())
+	}
+
+	log.Printf("initialize markov chain %s...", name)
+	chain := initializeMarkovChain(files, snapshotPath, cfg.MarkovOrder)
+	chain.SetSubstringMatch(cfg.MarkovSubstringMatch)
+
+	model := &Model{
+		Name:         name,
+		Files:        files,
+		SnapshotPath: snapshotPath,
+		Chain:        chain,
+	}
+	registerModel(model)
+
+	return model
+}
+
+// getNetworkModelPaths returns the name of the model of a network, the
+// directory of its data files and its snapshot file.
+func getNetworkModelPaths(network NetworkCfg) (name, dataPath, snapshotPath string) {
+	if network.Model != ModelOwn {
+		return ModelShared, cfg.MarkovDataPath, cfg.SnapshotPath
+	}
+
+	dataPath = filepath.Join(cfg.MarkovDataPath,
+		logFilenameReplacer.Replace(network.Name))
+	return network.Name, dataPath, filepath.Join(dataPath, "chain.snapshot")
+}
+
+// loadModels loads the models used by the configured networks and returns
+// their registries by network.  The shared model is only loaded if a network
+// uses it.
+//
+// The channels with their own model are read from their autolog file, which
+// the model of their network skips.  Since the autolog files are named after
+// the channel only, a channel given its own model by a network has it on all
+// the networks logging into the same directory.
+func loadModels() map[string]*ModelRegistry {
+	owned := make(map[string][]string)
+	for _, network := range cfg.Networks {
+		_, dataPath, _ := getNetworkModelPaths(network)
+		for channel, model := range network.ChannelModels {
+			if model.Model != ModelOwn ||
+				containsFold(owned[dataPath], channel) {
+				continue
+			}
+			owned[dataPath] = append(owned[dataPath], channel)
+		}
+	}
+
+	loaded := make(map[string]*Model)
+	registries := make(map[string]*ModelRegistry)
+
+	for _, network := range cfg.Networks {
+		name, dataPath, snapshotPath := getNetworkModelPaths(network)
+
+		shared := loaded[dataPath]
+		if shared == nil {
+			var excluded []string
+			for _, channel := range owned[dataPath] {
+				excluded = append(excluded, getLogBasename(channel))
+			}
+			shared = loadModel(name, DataFiles{
+				Path:    dataPath,
+				Exclude: excluded,
+			}, snapshotPath)
+			if cfg.SpeakerModels {
+				shared.enableSpeakers(filepath.Join(dataPath,
+					"speakers"))
+			}
+			loaded[dataPath] = shared
+		}
+
+		registry := newModelRegistry(shared)
+		for _, channel := range owned[dataPath] {
+			key := filepath.Join(dataPath, ircLower(channel))
+			model := loaded[key]
+			if model == nil {
+				model = loadModel(channel, DataFiles{
+					Path: dataPath,
+					Only: []string{getLogBasename(channel)},
+				}, filepath.Join(dataPath, "chain-"+
+					logFilenameReplacer.Replace(channel)+
+					".snapshot"))
+				if cfg.SpeakerModels {
+					model.enableSpeakers(filepath.Join(dataPath,
+						"speakers-"+
+							logFilenameReplacer.Replace(channel)))
+				}
+				loaded[key] = model
+			}
+			registry.channels[ircLower(channel)] = model
+		}
+
+		for channel, model := range network.ChannelModels {
+			if len(model.Blend) > 0 {
+				registry.blends[ircLower(channel)] =
+					registry.newBlend(model.Blend)
+			}
+		}
+
+		registries[network.Name] = registry
+	}
+
+	return registries
+}
+
+// registerModel adds a model to the ones saved by snapshotModels.
+func registerModel(model *Model) {
+	modelsMutex.Lock()
+	defer modelsMutex.Unlock()
+	models = append(models, model)
+}
+
+// getLogBasename returns the name of the autolog files for the given channel,
+// without extension.
+func getLogBasename(channel string) string {
+	return "autolog-" + logFilenameReplacer.Replace(channel)
+}
+
+// getLogFilename returns the path of the structured autolog file for the given
+// channel.
+func (m *Model) getLogFilename(channel string) string {
+	return filepath.Join(m.Files.Path,
+		getLogBasename(channel)+structuredLogExt)
+}
+
+// logLine appends a line to filename.
+func logLine(filename, line string) {
+	line = logLineReplacer.Replace(line)
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		log.Printf("Error opening %s for logging: %s", filename,
+			err.Error())
+		return
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(line + "\n")
+	if err != nil {
+		log.Printf("Error writing to %s for logging: %s", filename,
+			err.Error())
+		return
+	}
+}
+
+// atomicFile is a temporary file replacing filename once committed, so a
+// crash never leaves a truncated file behind.
+type atomicFile struct {
+	*bufio.Writer
+	filename string
+	tmp      *os.File
+}
+
+// createAtomicFile creates the temporary file of filename, next to it.
+func createAtomicFile(filename string) (*atomicFile, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename),
+		"."+filepath.Base(filename)+"-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicFile{
+		Writer:   bufio.NewWriter(tmp),
+		filename: filename,
+		tmp:      tmp,
+	}, nil
+}
+
+// Commit replaces filename with what was written, with the given mode.
+func (f *atomicFile) Commit(mode os.FileMode) error {
+	err := f.Flush()
+	if err == nil {
+		err = f.tmp.Sync()
+	}
+	if cerr := f.tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.tmp.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(f.tmp.Name(), f.filename)
+	}
+	if err != nil {
+		os.Remove(f.tmp.Name())
+	}
+	return err
+}
+
+// Abort discards what was written, filename is left untouched.  It does
+// nothing once committed.
+func (f *atomicFile) Abort() {
+	if f.tmp.Close() == nil {
+		os.Remove(f.tmp.Name())
+	}
+}
+
+// writeFileAtomic writes filename with the given mode through write, see
+// atomicFile.
+func writeFileAtomic(filename string, mode os.FileMode, write func(w io.Writer) error) error {
+	f, err := createAtomicFile(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := write(f); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit(mode)
+}
+
+// Learn adds the line of a record to the chain and logs the record.
+func (m *Model) Learn(record LogRecord) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	line := record.Line()
+	m.Chain.AddLine(line)
+	appendRecord(m.getLogFilename(record.Channel), record)
+
+	if m.SpeakersPath != "" {
+		appendRecord(m.getSpeakerFilename(record.Nick), record)
+		if chain, ok := m.speakers[ircLower(record.Nick)]; ok {
+			chain.AddLine(line)
+		}
+	}
+}
+
+// Forget removes the records matching from the structured logs of the model
+// and their lines from the chain, and returns how many.  The snapshot is saved
+// right away so its offsets match the rewritten logs.  The lines of the plain
+// text logs are kept since their authors are unknown.  The records are also
+// removed from the logs of the speakers, the ones left empty are removed.
+//
+// The logs are filtered without blocking the learning, only the records
+// logged meanwhile are filtered once it is blocked, before the logs are
+// replaced and the chain updated.
+func (m *Model) Forget(match func(LogRecord) bool) (int, error) {
+	// Two rewrites of the same log would not find it where they left it.
+	m.forgetMutex.Lock()
+	defer m.forgetMutex.Unlock()
+
+	// The sizes are taken while learning is blocked so they never fall in
+	// the middle of a record.
+	m.mutex.Lock()
+	fileInfos, err := m.Files.List()
+	var speakerInfos []os.FileInfo
+	if err == nil && m.SpeakersPath != "" {
+		speakerInfos, err = ioutil.ReadDir(m.SpeakersPath)
+	}
+	m.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	rewrites, err := startLogRewrites(m.Files.Path, fileInfos, match)
+	defer abortLogRewrites(rewrites)
+	if err != nil {
+		return 0, err
+	}
+	speakerRewrites, err := startLogRewrites(m.SpeakersPath, speakerInfos,
+		match)
+	defer abortLogRewrites(speakerRewrites)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	forgotten, err := m.finishForget(rewrites, speakerRewrites)
+
+	// An outdated snapshot would bring the lines back upon restart, and
+	// the words only they used would stay in its dictionary.  This holds
+	// as soon as a log was rewritten, even if another one failed.
+	if forgotten > 0 {
+		m.Chain.Compact()
+		serr := saveSnapshot(m.Chain, m.SnapshotPath, m.Files)
+		if serr != nil {
+			os.Remove(m.SnapshotPath)
+			if err == nil {
+				err = serr
+			}
+		}
+	}
+
+	return forgotten, err
+}
+
+// finishForget replaces the logs with their rewrites and removes the records
+// from the chain and the speakers, see Forget.  It returns how many records
+// were removed from the logs of the model before any error.  Learning must be
+// held meanwhile.
+func (m *Model) finishForget(rewrites, speakerRewrites []*logRewrite) (int, error) {
+	forgotten := 0
+	for _, rewrite := range rewrites {
+		if err := rewrite.Finish(); err != nil {
+			return forgotten, err
+		}
+		for _, record := range rewrite.removed {
+			m.Chain.RemoveLine(record.Line())
+		}
+		forgotten += len(rewrite.removed)
+	}
+
+	for _, rewrite := range speakerRewrites {
+		if err := rewrite.Finish(); err != nil {
+			return forgotten, err
+		}
+		for _, record := range rewrite.removed {
+			delete(m.speakers, ircLower(record.Nick))
+		}
+		if rewrite.kept == 0 {
+			if err := os.Remove(rewrite.filename); err != nil {
+				return forgotten, err
+			}
+		}
+	}
+
+	return forgotten, nil
+}
+
+// Snapshot saves the chain to the snapshot file and logs the outcome.
+func (m *Model) Snapshot() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := saveSnapshot(m.Chain, m.SnapshotPath, m.Files)
+	if err != nil {
+		log.Printf("snapshot: unable to save %s: %s", m.SnapshotPath,
+			err.Error())
+		return
+	}
+	log.Printf("snapshot: saved %s", m.SnapshotPath)
+}
+
+// snapshotModels saves all the loaded models.
+func snapshotModels() {
+	modelsMutex.Lock()
+	defer modelsMutex.Unlock()
+
+	for _, model := range models {
+		model.Snapshot()
+	}
+}
+
+// ModelRegistry gives the models a network learns into and answers from, by
+// channel.  Channel names follow the rfc1459 casemapping.
+type ModelRegistry struct {
+	// shared is the model of the network, used by the channels without
+	// a model of their own and the private messages.
+	shared   *Model
+	channels map[string]*Model
+	blends   map[string]*Blend
+}
+
+func newModelRegistry(shared *Model) *ModelRegistry {
+	return &ModelRegistry{
+		shared:   shared,
+		channels: make(map[string]*Model),
+		blends:   make(map[string]*Blend),
+	}
+}
+
+// Learner returns the model learning what is said on channel.
+func (r *ModelRegistry) Learner(channel string) *Model {
+	if model, ok := r.channels[ircLower(channel)]; ok {
+		return model
+	}
+	return r.shared
+}
+
+// Blend returns the models answering on channel, by default the one learning
+// from it.
+func (r *ModelRegistry) Blend(channel string) *Blend {
+	if blend, ok := r.blends[ircLower(channel)]; ok {
+		return blend
+	}
+	return &Blend{
+		models:  []*Model{r.Learner(channel)},
+		weights: []int{1},
+	}
+}
+
+// newBlend returns a Blend of the models named in weights, see
+// ChannelModelCfg.Blend.  The models are sorted by name so a seed always
+// picks the same one.
+func (r *ModelRegistry) newBlend(weights map[string]int) *Blend {
+	var names []string
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	blend := &Blend{}
+	for _, name := range names {
+		model := r.shared
+		if name != ModelShared {
+			model = r.Learner(name)
+		}
+		blend.models = append(blend.models, model)
+		blend.weights = append(blend.weights, weights[name])
+	}
+
+	return blend
+}
+
+// Models returns all the models of the registry, once each.
+func (r *ModelRegistry) Models() []*Model {
+	models := []*Model{r.shared}
+	for _, model := range r.channels {
+		if model != r.shared {
+			models = append(models, model)
+		}
+	}
+	return models
+}
+
+// Snapshot saves all the models of the registry.
+func (r *ModelRegistry) Snapshot() {
+	for _, model := range r.Models() {
+		model.Snapshot()
+	}
+}
+
+// Blend answers from several models, weighted.
+type Blend struct {
+	models  []*Model
+	weights []int
+}
+
+// Pick returns the model answering on topic for the given seed.  Only the
+// models knowing a word of the topic are considered, unless none does, and
+// they are picked randomly according to their weights.
+func (b *Blend) Pick(seed int64, topic string) *Model {
+	if len(b.models) == 1 {
+		return b.models[0]
+	}
+
+	candidates := make([]int, 0, len(b.models))
+	for i, model := range b.models {
+		for _, word := range model.Chain.GetScoredWords(topic) {
+			if word.Score > 0 {
+				candidates = append(candidates, i)
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range b.models {
+			candidates = append(candidates, i)
+		}
+	}
+
+	total := 0
+	for _, i := range candidates {
+		total += b.weights[i]
+	}
+
+	n := rand.New(rand.NewSource(seed)).Intn(total)
+	for _, i := range candidates {
+		if n < b.weights[i] {
+			return b.models[i]
+		}
+		n -= b.weights[i]
+	}
+
+	return b.models[candidates[len(candidates)-1]]
+}
+
+// containsFold returns true if a string of list is equal to s under the
+// rfc1459 casemapping, like the channels they are usually named after.
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if ircEqual(item, s) {
+			return true
+		}
+	}
+	return false
+}
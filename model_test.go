@@ -0,0 +1,209 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadModels(t *testing.T) {
+	setupTestBot(t)
+	cfg.MarkovOrder = 2
+	cfg.SnapshotPath = filepath.Join(cfg.MarkovDataPath, "chain.snapshot")
+	cfg.Networks = []NetworkCfg{
+		{Name: "oftc", Model: ModelShared},
+		{Name: "libera", Model: ModelShared},
+		{Name: "work/irc", Model: ModelOwn},
+	}
+	models = nil
+	t.Cleanup(func() { models = nil })
+
+	byNetwork := loadModels()
+	if byNetwork["oftc"].shared != byNetwork["libera"].shared {
+		t.Fatal("shared model loaded twice")
+	}
+	if byNetwork["oftc"].shared == byNetwork["work/irc"].shared {
+		t.Fatal("own model is shared")
+	}
+	if len(models) != 2 {
+		t.Fatalf("wrong number of registered models: %d", len(models))
+	}
+
+	own := byNetwork["work/irc"].shared
+	if own.Files.Path != filepath.Join(cfg.MarkovDataPath, "work_irc") {
+		t.Fatalf("own model data escaped: %s", own.Files.Path)
+	}
+
+	work := newNetwork(NetworkCfg{Name: "work/irc"}, byNetwork["work/irc"])
+	work.MessageHandler(Speaker{Nick: "bob"}, "#ops", "le serveur est tombé", time.Now())
+	if byNetwork["oftc"].shared.Chain.GetScoredWords("serveur")[0].Score != 0 {
+		t.Fatal("own model learned into the shared one")
+	}
+	if own.Chain.GetScoredWords("serveur")[0].Score != 1 {
+		t.Fatal("own model did not learn")
+	}
+	if _, err := os.Stat(own.getLogFilename("#ops")); err != nil {
+		t.Fatal("line not logged in the own model: ", err)
+	}
+}
+
+// setupChannelModels writes autologs for #work and #debsquad, unless they
+// exist, and loads the models with the given channel settings.
+func setupChannelModels(t *testing.T, channelModels map[string]ChannelModelCfg) *ModelRegistry {
+	for channel, line := range map[string]string{
+		"#work":     "le serveur est tombé",
+		"#debsquad": "le chat dort sur le canapé",
+	} {
+		filename := filepath.Join(cfg.MarkovDataPath, getLogBasename(channel)+".txt")
+		if _, err := os.Stat(filename); err == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(filename, []byte(line+"\n"), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.MarkovOrder = 2
+	cfg.SnapshotPath = filepath.Join(cfg.MarkovDataPath, "chain.snapshot")
+	cfg.Networks = []NetworkCfg{
+		{Name: "oftc", ChannelModels: channelModels},
+	}
+	if err := cfg.Networks[0].setChannelModelDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	models = nil
+	t.Cleanup(func() { models = nil })
+
+	return loadModels()["oftc"]
+}
+
+func TestChannelModels(t *testing.T) {
+	setupTestBot(t)
+	registry := setupChannelModels(t, map[string]ChannelModelCfg{
+		"#Work": {Model: ModelOwn},
+	})
+
+	work := registry.Learner("#work")
+	if work == registry.shared {
+		t.Fatal("#work has no model of its own")
+	}
+	if registry.Learner("#debsquad") != registry.shared {
+		t.Fatal("#debsquad has a model of its own")
+	}
+	if work.Chain.GetScoredWords("serveur")[0].Score != 1 ||
+		work.Chain.GetScoredWords("chat")[0].Score != 0 {
+		t.Fatal("#work model not built from its autolog only")
+	}
+	if registry.shared.Chain.GetScoredWords("serveur")[0].Score != 0 ||
+		registry.shared.Chain.GetScoredWords("chat")[0].Score != 1 {
+		t.Fatal("#work autolog leaked into the shared model")
+	}
+
+	network := newNetwork(NetworkCfg{Name: "oftc"}, registry)
+	network.MessageHandler(Speaker{Nick: "bob"}, "#WORK", "la base est tombée", time.Now())
+	if registry.shared.Chain.GetScoredWords("base")[0].Score != 0 {
+		t.Fatal("#work line learned into the shared model")
+	}
+	registry.Snapshot()
+
+	// Once restored, the lines logged since are replayed in their model.
+	network.MessageHandler(Speaker{Nick: "bob"}, "#work", "le réseau est tombé", time.Now())
+	registry = setupChannelModels(t, map[string]ChannelModelCfg{
+		"#work": {Model: ModelOwn},
+	})
+	work = registry.Learner("#work")
+	if work.Chain.GetScoredWords("base")[0].Score != 1 ||
+		work.Chain.GetScoredWords("réseau")[0].Score != 1 {
+		t.Fatal("#work model not restored")
+	}
+	if registry.shared.Chain.GetScoredWords("réseau")[0].Score != 0 {
+		t.Fatal("#work line replayed in the shared model")
+	}
+}
+
+func TestChannelModelsCasemapping(t *testing.T) {
+	setupTestBot(t)
+	filename := filepath.Join(cfg.MarkovDataPath, "autolog-#OPS{.txt")
+	if err := ioutil.WriteFile(filename, []byte("le serveur est en panne\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	registry := setupChannelModels(t, map[string]ChannelModelCfg{
+		"#ops[": {Model: ModelOwn},
+	})
+
+	ops := registry.Learner("#Ops{")
+	if ops == registry.shared || ops != registry.Learner("#OPS[") {
+		t.Fatal("#ops[ and #OPS{ have different models")
+	}
+	if ops.Chain.GetScoredWords("panne")[0].Score != 1 ||
+		registry.shared.Chain.GetScoredWords("panne")[0].Score != 0 {
+		t.Fatal("#OPS{ autolog not read by the #ops[ model")
+	}
+	if cfg.Networks[0].GetChannelModel("#OPS{").Model != ModelOwn {
+		t.Fatal("#OPS{ settings not found")
+	}
+}
+
+func TestChannelModelsSnapshotRebuilt(t *testing.T) {
+	setupTestBot(t)
+	registry := setupChannelModels(t, nil)
+	registry.Snapshot()
+
+	// #work now has its own model, the shared snapshot includes its lines
+	// and must be rebuilt.
+	registry = setupChannelModels(t, map[string]ChannelModelCfg{
+		"#work": {Model: ModelOwn},
+	})
+	if registry.shared.Chain.GetScoredWords("serveur")[0].Score != 0 {
+		t.Fatal("shared snapshot restored with the #work lines")
+	}
+}
+
+func TestChannelModelsBlend(t *testing.T) {
+	setupTestBot(t)
+	registry := setupChannelModels(t, map[string]ChannelModelCfg{
+		"#work": {Model: ModelOwn},
+		"#debsquad": {Blend: map[string]int{
+			"#work":     1,
+			ModelShared: 1,
+		}},
+	})
+	work := registry.Learner("#work")
+
+	if registry.Blend("#work").Pick(1, "chat") != work {
+		t.Fatal("#work does not answer from its own model")
+	}
+
+	// Only the models knowing the topic are picked.
+	blend := registry.Blend("#debsquad")
+	for seed := int64(0); seed < 20; seed++ {
+		if blend.Pick(seed, "serveur") != work {
+			t.Fatal("serveur answered from the shared model")
+		}
+		if blend.Pick(seed, "chat") != registry.shared {
+			t.Fatal("chat answered from the #work model")
+		}
+	}
+
+	picked := make(map[*Model]bool)
+	for seed := int64(0); seed < 20; seed++ {
+		picked[blend.Pick(seed, "inconnu")] = true
+	}
+	if len(picked) != 2 {
+		t.Fatal("unknown topic not answered from both models")
+	}
+}
+
+func TestChannelModelsBlendInvalid(t *testing.T) {
+	network := NetworkCfg{ChannelModels: map[string]ChannelModelCfg{
+		"#debsquad": {Blend: map[string]int{"#work": 1}},
+	}}
+	if err := network.setChannelModelDefaults(); err == nil {
+		t.Fatal("blend of a channel without model accepted")
+	}
+}
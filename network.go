@@ -0,0 +1,100 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Network is the connection of the bot to an IRC network along with its own
+// state.  Networks run concurrently, they only share their markov models if
+// configured to.
+type Network struct {
+	config NetworkCfg
+	models *ModelRegistry
+
+	transport  Transport
+	sendQueue  *OutgoingQueue
+	supervisor *Supervisor
+
+	// replyLoops detects other bots answering to our answers.
+	replyLoops *loopDetector
+
+	// forgetting tracks the forget requests running in the background.
+	forgetting sync.WaitGroup
+
+	// lastSeeds is the request reproducing the last answer, per target, see
+	// rememberSeed.
+	lastSeeds      map[string]string
+	lastSeedsMutex sync.Mutex
+}
+
+// newNetwork returns a Network without transport, see setTransport.
+func newNetwork(config NetworkCfg, models *ModelRegistry) *Network {
+	return &Network{
+		config:     config,
+		models:     models,
+		supervisor: NewSupervisor(),
+		replyLoops: newLoopDetector(),
+		lastSeeds:  make(map[string]string),
+	}
+}
+
+// NewNetwork returns a Network connecting with the configured transport and
+// learning into the models of the registry.
+func NewNetwork(config NetworkCfg, models *ModelRegistry) (*Network, error) {
+	n := newNetwork(config, models)
+
+	options, err := config.GetTransportOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := newTransport(config.Transport, options, n.handlers())
+	if err != nil {
+		return nil, err
+	}
+	n.setTransport(transport)
+
+	return n, nil
+}
+
+// handlers returns the transport event handlers of the network.
+func (n *Network) handlers() EventHandlers {
+	return EventHandlers{
+		Welcome:     n.welcome,
+		Message:     n.MessageHandler,
+		Action:      n.ActionHandler,
+		NickChanged: n.nickChanged,
+		Joined:      n.supervisor.Joined,
+		Parted:      n.supervisor.Parted,
+	}
+}
+
+// setTransport connects the network through transport, with its own
+// outgoing queue.
+func (n *Network) setTransport(transport Transport) {
+	n.transport = transport
+	n.sendQueue = NewOutgoingQueue(transport, n.config.FloodBurst,
+		n.config.GetFloodInterval())
+}
+
+// Run keeps the network connected until it quits.
+func (n *Network) Run() {
+	log.Printf("[%s] connecting to %s as %s", n.config.Name,
+		n.config.IRCServer, n.config.IRCNickname)
+
+	go n.sendQueue.Run()
+	defer n.sendQueue.Close()
+	defer n.forgetting.Wait()
+
+	if interval := n.config.GetNickRegainInterval(); interval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go n.nickRegainLoop(interval, done)
+	}
+
+	n.supervisor.Run(n.transport, n.models.Snapshot)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Commands used to take the configured nick back from another client.
+const (
+	NickServGhost  = "GHOST"
+	NickServRegain = "REGAIN"
+)
+
+// nickServ is the services bot handling the registered nicks.
+const nickServ = "NickServ"
+
+// isOwnNick returns true if name is the configured nick or the one the bot
+// currently uses, if it had to pick another one.
+func (n *Network) isOwnNick(name string) bool {
+	if ircEqual(name, n.config.IRCNickname) {
+		return true
+	}
+	return n.transport != nil && ircEqual(name, n.transport.Nick())
+}
+
+// identify logs in with NickServ, unless SASL did already.
+func (n *Network) identify() {
+	password := secrets.For(n.config.Name).NickServPassword
+	if password == "" || n.config.SASLMechanism != "" {
+		return
+	}
+
+	log.Printf("[%s] identifying with %s as %s", n.config.Name, nickServ,
+		n.config.IRCNickname)
+	n.transport.Privmsg(nickServ, "IDENTIFY "+n.config.IRCNickname+" "+
+		password)
+}
+
+// regainNick tries to get the configured nick back: without password the bot
+// can only wait for it to be available, with a password NickServ can kill
+// the client using it.
+func (n *Network) regainNick() {
+	nick := n.config.IRCNickname
+	if ircEqual(n.transport.Nick(), nick) {
+		return
+	}
+
+	log.Printf("[%s] trying to regain %s (currently %s)", n.config.Name,
+		nick, n.transport.Nick())
+
+	password := secrets.For(n.config.Name).NickServPassword
+	switch {
+	case password == "":
+		n.transport.SetNick(nick)
+	case n.config.NickServRecoverCommand == NickServRegain:
+		// REGAIN also switches us to the nick.
+		n.transport.Privmsg(nickServ, "REGAIN "+nick+" "+password)
+	default:
+		n.transport.Privmsg(nickServ, "GHOST "+nick+" "+password)
+		n.transport.SetNick(nick)
+	}
+}
+
+// nickServWelcome identifies the bot, or regains its nick first if it had to
+// register with another one.
+func (n *Network) nickServWelcome() {
+	if ircEqual(n.transport.Nick(), n.config.IRCNickname) {
+		n.identify()
+	} else {
+		n.regainNick()
+	}
+}
+
+// nickChanged identifies the bot once it got its nick back.
+func (n *Network) nickChanged(nick string) {
+	if ircEqual(nick, n.config.IRCNickname) {
+		log.Printf("[%s] regained %s", n.config.Name, nick)
+		n.identify()
+	}
+}
+
+// nickRegainLoop periodically tries to regain the configured nick, until done
+// is closed.  No attempt is made while the bot is not connected and welcomed,
+// the nick is chosen again on registration anyway.
+func (n *Network) nickRegainLoop(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if n.supervisor.Connected() {
+				n.regainNick()
+			}
+		}
+	}
+}
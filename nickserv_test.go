@@ -0,0 +1,182 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// registerTaken registers the bot while its nick is taken, it ends up with an
+// underscore.
+func registerTaken(server *fakeServer) {
+	server.t.Helper()
+
+	server.Expect("CAP LS 302")
+	server.Expect("NICK paglop")
+	server.Expect("USER paglop localhost 127.0.0.1 :paglop")
+	server.Send(":irc.example.org 433 * paglop :Nickname is already in use")
+	server.Expect("NICK paglop_")
+	server.Send(":irc.example.org 001 paglop_ :Welcome")
+}
+
+func TestNickServIdentify(t *testing.T) {
+	_, server := startNativeBot(t, "#debsquad")
+	secrets.NickServPassword = "hunter2"
+
+	server.Register("paglop")
+	server.Expect("PRIVMSG NickServ :IDENTIFY paglop hunter2")
+	server.Expect("JOIN #debsquad")
+}
+
+func TestNickServNotWithSASL(t *testing.T) {
+	network, server := startNativeBot(t, "#debsquad")
+	secrets.NickServPassword = "hunter2"
+	network.config.SASLMechanism = SASLPlain
+
+	server.Register("paglop")
+	server.Expect("JOIN #debsquad")
+}
+
+func TestNickServGhost(t *testing.T) {
+	network, server := startNativeBot(t, "#debsquad")
+	secrets.NickServPassword = "hunter2"
+
+	registerTaken(server)
+	server.Expect("PRIVMSG NickServ :GHOST paglop hunter2")
+	server.Expect("NICK paglop")
+	server.Expect("JOIN #debsquad")
+
+	server.Send(":paglop_!~paglop@example.org NICK :paglop")
+	server.Expect("PRIVMSG NickServ :IDENTIFY paglop hunter2")
+	if nick := network.transport.Nick(); nick != "paglop" {
+		t.Fatalf("nick not regained: %s", nick)
+	}
+}
+
+func TestNickServRegain(t *testing.T) {
+	network, server := startNativeBot(t)
+	secrets.NickServPassword = "hunter2"
+	network.config.NickServRecoverCommand = NickServRegain
+
+	registerTaken(server)
+	server.Expect("PRIVMSG NickServ :REGAIN paglop hunter2")
+	server.Send(":paglop_!~paglop@example.org NICK :paglop")
+	server.Expect("PRIVMSG NickServ :IDENTIFY paglop hunter2")
+}
+
+func TestRegainNickWithoutPassword(t *testing.T) {
+	network, server := startNativeBot(t)
+
+	registerTaken(server)
+	server.Expect("NICK paglop")
+	server.Send(":irc.example.org 433 paglop_ paglop :Nickname is already in use")
+	server.Sync()
+
+	// The periodic attempts only send a NICK, until it works.
+	network.regainNick()
+	server.Expect("NICK paglop")
+	server.Send(":paglop_!~paglop@example.org NICK :paglop")
+	server.Sync()
+
+	network.regainNick()
+	server.Sync()
+}
+
+// nickTransport is a disconnected Transport recording the nick changes.
+type nickTransport struct {
+	nullTransport
+	changes chan string
+}
+
+func (t *nickTransport) SetNick(nick string) { t.changes <- nick }
+
+func TestNickRegainLoop(t *testing.T) {
+	network, _ := setupTestBot(t)
+	transport := &nickTransport{
+		nullTransport: nullTransport{nick: "paglop_"},
+		changes:       make(chan string, 100),
+	}
+	network.setTransport(transport)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		network.nickRegainLoop(time.Millisecond, done)
+		close(stopped)
+	}()
+
+	// Nothing is attempted until the server welcomed the bot.
+	time.Sleep(20 * time.Millisecond)
+	if len(transport.changes) != 0 {
+		t.Fatal("nick regained while not connected")
+	}
+
+	network.supervisor.Welcomed()
+	select {
+	case nick := <-transport.changes:
+		if nick != "paglop" {
+			t.Fatalf("wrong nick regained: %s", nick)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nick not regained once connected")
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("regain loop not stopped")
+	}
+}
+
+func TestAddressedWithCurrentNick(t *testing.T) {
+	network, output := setupTestBot(t)
+	network.setTransport(&nullTransport{nick: "paglop_"})
+
+	for _, body := range []string{"paglop_: le chat", "Paglop, le chat", "PAGLOP_ le chat"} {
+		output.Reset()
+		network.MessageHandler(Speaker{Nick: "bob"}, "#debsquad", body, time.Now())
+		if !strings.HasPrefix(output.String(), "PRIVMSG #debsquad :") {
+			t.Fatalf("%q not answered", body)
+		}
+	}
+
+	output.Reset()
+	network.MessageHandler(Speaker{Nick: "bob"}, "#debsquad", "paglop|away: le chat", time.Now())
+	if output.Len() != 0 {
+		t.Fatalf("answered to another nick: %q", output.String())
+	}
+}
+
+func TestRedactLine(t *testing.T) {
+	for line, expected := range map[string]string{
+		"PRIVMSG NickServ :IDENTIFY paglop hunter2":  "PRIVMSG NickServ :IDENTIFY <redacted>",
+		"PRIVMSG nickserv :GHOST paglop hunter2":     "PRIVMSG nickserv :GHOST <redacted>",
+		"AUTHENTICATE cGFnbG9wAHBhZ2xvcABodW50ZXIy":  "AUTHENTICATE <redacted>",
+		"AUTHENTICATE PLAIN":                         "AUTHENTICATE PLAIN",
+		"AUTHENTICATE +":                             "AUTHENTICATE +",
+		":paglop!~p@h PRIVMSG NickServ :REGAIN a b":  ":paglop!~p@h PRIVMSG NickServ :REGAIN <redacted>",
+		"@a=b :nickserv PRIVMSG NickServ :HELP":      "@a=b :nickserv PRIVMSG NickServ :HELP",
+		"PRIVMSG #debsquad :IDENTIFY paglop hunter2": "PRIVMSG #debsquad :IDENTIFY paglop hunter2",
+	} {
+		if redacted := redactLine(line); redacted != expected {
+			t.Errorf("%q: got %q", line, redacted)
+		}
+	}
+}
+
+func TestNickServEchoNotTracked(t *testing.T) {
+	network, server := startNativeBot(t, "#debsquad")
+	secrets.NickServPassword = "hunter2"
+
+	server.Register("paglop", "echo-message")
+	server.Expect("PRIVMSG NickServ :IDENTIFY paglop hunter2")
+	server.Expect("JOIN #debsquad")
+	server.Sync()
+	if n := network.transport.(*nativeTransport).undelivered(); n != 0 {
+		t.Fatalf("waiting for the echo of a password: %d", n)
+	}
+}
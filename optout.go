@@ -0,0 +1,207 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	// Detect the requests to stop learning from someone, and the explicit
+	// requests to also forget what was learned from them.
+	reOptOut = regexp.MustCompile(`(?i)^(?:ne m'apprends? pas|don't learn from me|forget me|oublie[- ]moi)\s*[.!]*$`)
+	reForget = regexp.MustCompile(`(?i)^(?:oublie[- ]moi tout|forget everything(?: about me)?)\s*[.!]*$`)
+)
+
+// OptOut is someone who asked the bot not to learn from them on a network,
+// identified by nick and services account if they had one.
+type OptOut struct {
+	Network string `json:"network"`
+	Nick    string `json:"nick"`
+	Account string `json:"account,omitempty"`
+}
+
+// matches returns true if speaker is the one who opted out, by nick or by
+// account: either is enough.
+func (o OptOut) matches(network string, speaker Speaker) bool {
+	if o.Network != network {
+		return false
+	}
+	if o.Account != "" && strings.EqualFold(o.Account, speaker.Account) {
+		return true
+	}
+	return ircEqual(o.Nick, speaker.Nick)
+}
+
+// matchesRecord returns true if a record of the structured logs was said by
+// the one who opted out.  Only the account is trusted since anyone can take a
+// nick, records without network (e.g. imported) are matched on any network.
+func (o OptOut) matchesRecord(record LogRecord) bool {
+	if record.Network != "" && record.Network != o.Network {
+		return false
+	}
+	return o.Account != "" && strings.EqualFold(o.Account, record.Account)
+}
+
+// OptOuts are the people the bot must not learn from, saved to a file so they
+// persist across restarts.
+type OptOuts struct {
+	path    string
+	mutex   sync.Mutex
+	entries []OptOut
+}
+
+var optOuts = &OptOuts{}
+
+// parseOptOutFile loads the opt-out file into the global optOuts, the file is
+// created upon the first opt-out.
+func parseOptOutFile(path string) error {
+	loaded := &OptOuts{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &loaded.entries)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	optOuts = loaded
+	return nil
+}
+
+// Has returns true if speaker opted out on the network.
+func (o *OptOuts) Has(network string, speaker Speaker) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, entry := range o.entries {
+		if entry.matches(network, speaker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add records the opt-out of speaker on the network and saves the file.
+func (o *OptOuts) Add(network string, speaker Speaker) (OptOut, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entry := OptOut{
+		Network: network,
+		Nick:    speaker.Nick,
+		Account: speaker.Account,
+	}
+	for _, existing := range o.entries {
+		if existing == entry {
+			return entry, nil
+		}
+	}
+	o.entries = append(o.entries, entry)
+
+	return entry, o.save()
+}
+
+// save writes the opt-outs to the file atomically, nothing is saved without
+// file (e.g. in the tests).
+func (o *OptOuts) save() error {
+	if o.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(o.entries, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(o.path, 0660, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// optOut handles the requests to stop learning from speaker, and to forget
+// what was learned from them, it returns false if body is not one of them.
+func (n *Network) optOut(speaker Speaker, target, body string) bool {
+	forget := reForget.MatchString(body)
+	if !forget && !reOptOut.MatchString(body) {
+		return false
+	}
+
+	entry, err := optOuts.Add(n.config.Name, speaker)
+	if err != nil {
+		log.Printf("[%s] unable to save the opt-out of %s: %s",
+			n.config.Name, speaker.Nick, err.Error())
+		n.sendMessage(target, fmt.Sprintf("%s: désolé, je n'y arrive "+
+			"pas", speaker.Nick))
+		return true
+	}
+	log.Printf("[%s] %s opted out", n.config.Name, speaker.Nick)
+
+	if !forget {
+		n.sendMessage(target, fmt.Sprintf("%s: d'accord, je n'apprends "+
+			"plus rien de toi", speaker.Nick))
+		return true
+	}
+
+	// Without account, nothing proves the lines logged under that nick
+	// are theirs.
+	if speaker.Account == "" {
+		n.sendMessage(target, fmt.Sprintf("%s: je n'apprends plus rien "+
+			"de toi, mais identifie-toi pour que j'oublie", speaker.Nick))
+		return true
+	}
+
+	n.forgetting.Add(1)
+	go func() {
+		defer n.forgetting.Done()
+		n.forgetAndReply(entry, target)
+	}()
+	return true
+}
+
+// forgetAndReply forgets someone who opted out and tells them on target once
+// done.
+func (n *Network) forgetAndReply(entry OptOut, target string) {
+	forgotten, err := n.forget(entry)
+	if err != nil {
+		log.Printf("[%s] unable to forget %s: %s", n.config.Name,
+			entry.Nick, err.Error())
+		n.sendMessage(target, fmt.Sprintf("%s: je n'apprends plus rien "+
+			"de toi, mais je n'arrive pas à oublier", entry.Nick))
+		return
+	}
+
+	n.sendMessage(target, fmt.Sprintf("%s: d'accord, j'ai oublié %d "+
+		"lignes de toi", entry.Nick, forgotten))
+}
+
+// forget removes what was learned from someone who opted out from all the
+// models of the network, and returns the number of lines forgotten.  The logs
+// are rewritten, which takes a while, see forgetAndReply.
+func (n *Network) forget(entry OptOut) (int, error) {
+	total := 0
+	for _, model := range n.models.Models() {
+		forgotten, err := model.Forget(entry.matchesRecord)
+		total += forgotten
+		if err != nil {
+			return total, err
+		}
+	}
+
+	log.Printf("[%s] forgot %d lines from %s", n.config.Name, total,
+		entry.Nick)
+	return total, nil
+}
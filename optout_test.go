@@ -0,0 +1,247 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOptOut(t *testing.T) {
+	network, output := setupTestBot(t)
+	path := filepath.Join(cfg.MarkovDataPath, "optouts.json")
+	if err := parseOptOutFile(path); err != nil {
+		t.Fatal(err)
+	}
+	chain := network.models.shared.Chain
+
+	bob := Speaker{Nick: "bob", Account: "bobby"}
+	network.MessageHandler(bob, "#debsquad", "paglop: ne m'apprends pas", time.Now())
+	if output.String() != "PRIVMSG #debsquad :bob: d'accord, je n'apprends plus rien de toi\n" {
+		t.Fatalf("wrong answer to the opt-out: %q", output.String())
+	}
+
+	network.MessageHandler(bob, "#debsquad", "le chien dort", time.Now())
+	network.ActionHandler(bob, "#debsquad", "caresse le hibou", time.Now())
+	network.MessageHandler(Speaker{Nick: "bob_", Account: "bobby"}, "#debsquad", "le chien dort", time.Now())
+	if chain.GetScoredWords("chien")[0].Score != 0 || chain.GetScoredWords("hibou")[0].Score != 0 {
+		t.Fatal("learned from someone who opted out")
+	}
+
+	// Opt-outs are per network and persist across restarts.
+	if err := parseOptOutFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if !optOuts.Has("test", Speaker{Nick: "BOB"}) {
+		t.Fatal("opt-out not restored")
+	}
+	if optOuts.Has("libera", Speaker{Nick: "bob"}) {
+		t.Fatal("opt-out applied to another network")
+	}
+
+	network.MessageHandler(Speaker{Nick: "alice"}, "#debsquad", "le chien dort", time.Now())
+	if chain.GetScoredWords("chien")[0].Score != 1 {
+		t.Fatal("not learning from the others")
+	}
+}
+
+func TestOptOutPrivateNotLearned(t *testing.T) {
+	network, output := setupTestBot(t)
+	network.config.LearnFromPrivateMessages = true
+
+	network.MessageHandler(Speaker{Nick: "bob"}, "paglop", "oublie-moi !", time.Now())
+	if output.String() != "PRIVMSG bob :bob: d'accord, je n'apprends plus rien de toi\n" {
+		t.Fatalf("wrong answer to a private opt-out: %q", output.String())
+	}
+	if network.models.shared.Chain.GetScoredWords("oublie-moi")[0].Score != 0 {
+		t.Fatal("opt-out request learned")
+	}
+}
+
+func TestForget(t *testing.T) {
+	network, output := setupTestBot(t)
+	model := network.models.shared
+	model.enableSpeakers(filepath.Join(cfg.MarkovDataPath, "speakers"))
+	model.Chain = NewChain(2)
+
+	// A line learned from bob before the structured logs cannot be
+	// forgotten, nor can the lines of another bob on another network or
+	// without account.
+	legacy := filepath.Join(cfg.MarkovDataPath, "autolog-#debsquad.txt")
+	if err := ioutil.WriteFile(legacy, []byte("le hibou dort\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	model.Chain.AddLine("le hibou dort")
+	model.Learn(LogRecord{Network: "libera", Channel: "#debsquad", Nick: "bob", Kind: LogKindMessage, Text: "le lapin dort"})
+
+	bob := Speaker{Nick: "bob", Account: "bobby"}
+	network.MessageHandler(bob, "#debsquad", "le chien dort sur le tapis", time.Now())
+	network.MessageHandler(Speaker{Nick: "bob_", Account: "bobby"}, "#debsquad", "le chien mange", time.Now())
+	network.ActionHandler(bob, "#debsquad", "caresse le chien", time.Now())
+	network.MessageHandler(Speaker{Nick: "alice"}, "#debsquad", "le chat dort sur le canapé", time.Now())
+	network.MessageHandler(Speaker{Nick: "bob"}, "#work", "le cheval galope", time.Now())
+	model.Snapshot()
+	if model.Speaker("bob").LineCount() != 4 {
+		t.Fatal("speaker not recorded")
+	}
+
+	// Asking not to be learned from keeps what was learned.
+	network.MessageHandler(bob, "#debsquad", "paglop: forget me", time.Now())
+	if output.String() != "PRIVMSG #debsquad :bob: d'accord, je n'apprends plus rien de toi\n" {
+		t.Fatalf("wrong answer to the opt-out: %q", output.String())
+	}
+	if model.Chain.GetScoredWords("chien")[0].Score != 3 {
+		t.Fatal("lines forgotten without asking")
+	}
+
+	output.Reset()
+	network.MessageHandler(bob, "#debsquad", "paglop: forget everything!", time.Now())
+	network.forgetting.Wait()
+	if output.String() != "PRIVMSG #debsquad :bob: d'accord, j'ai oublié 3 lignes de toi\n" {
+		t.Fatalf("wrong answer to forget: %q", output.String())
+	}
+
+	check := func(chain *Chain) {
+		t.Helper()
+		for word, count := range map[string]uint64{
+			"chien":  0,
+			"tapis":  0,
+			"mange":  0,
+			"chat":   1,
+			"hibou":  1,
+			"lapin":  1,
+			"ACTION": 0,
+		} {
+			if score := chain.GetScoredWords(word)[0].Score; score != count {
+				t.Fatalf("wrong count for %s: %d", word, score)
+			}
+		}
+	}
+	check(model.Chain)
+
+	records := readRecords(t, model.getLogFilename("#debsquad"))
+	if len(records) != 2 || records[0].Nick != "bob" || records[1].Nick != "alice" {
+		t.Fatalf("wrong records after forget: %+v", records)
+	}
+
+	// Only the lines of the account are forgotten from the speaker logs,
+	// the ones left empty are removed.
+	records = readRecords(t, model.getSpeakerFilename("bob"))
+	if len(records) != 2 || records[0].Text != "le lapin dort" ||
+		records[1].Text != "le cheval galope" {
+		t.Fatalf("wrong speaker records after forget: %+v", records)
+	}
+	if _, err := os.Stat(model.getSpeakerFilename("bob_")); !os.IsNotExist(err) {
+		t.Fatal("empty speaker log not removed")
+	}
+	if model.Speaker("bob").LineCount() != 2 {
+		t.Fatal("speaker chain not rebuilt")
+	}
+
+	// The snapshot matches the rewritten logs, without the words only bob
+	// used.
+	chain, err := loadSnapshot(model.SnapshotPath, model.Files, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(chain)
+	for _, word := range []string{"chien", "tapis", "mange"} {
+		if chain.dict.Lookup(word) != NoWord {
+			t.Fatalf("forgotten word saved: %s", word)
+		}
+	}
+
+	// Nobody can imitate bob anymore.
+	output.Reset()
+	network.MessageHandler(Speaker{Nick: "alice"}, "#debsquad", "paglop: imite Bob", time.Now())
+	if output.String() != "PRIVMSG #debsquad :Bob ne veut pas\n" {
+		t.Fatalf("imitated someone who opted out: %q", output.String())
+	}
+}
+
+func TestForgetWithoutAccount(t *testing.T) {
+	network, output := setupTestBot(t)
+	model := network.models.shared
+	model.enableSpeakers(filepath.Join(cfg.MarkovDataPath, "speakers"))
+
+	network.MessageHandler(Speaker{Nick: "bob", Account: "bobby"}, "#debsquad", "le chien dort", time.Now())
+	network.MessageHandler(Speaker{Nick: "bob"}, "#debsquad", "paglop: oublie-moi tout", time.Now())
+	if output.String() != "PRIVMSG #debsquad :bob: je n'apprends plus rien de toi, mais identifie-toi pour que j'oublie\n" {
+		t.Fatalf("wrong answer to forget without account: %q", output.String())
+	}
+
+	if model.Chain.GetScoredWords("chien")[0].Score != 1 {
+		t.Fatal("lines forgotten on a nick")
+	}
+	if len(readRecords(t, model.getLogFilename("#debsquad"))) != 1 {
+		t.Fatal("records forgotten on a nick")
+	}
+	if _, err := os.Stat(model.getSpeakerFilename("bob")); err != nil {
+		t.Fatal("speaker log removed on a nick: ", err)
+	}
+}
+
+func TestForgetSpeakerByAccount(t *testing.T) {
+	network, _ := setupTestBot(t)
+	model := network.models.shared
+	model.enableSpeakers(filepath.Join(cfg.MarkovDataPath, "speakers"))
+
+	network.MessageHandler(Speaker{Nick: "bob", Account: "bobby"}, "#debsquad", "le chien dort", time.Now())
+	if model.Speaker("bob").LineCount() != 1 {
+		t.Fatal("speaker not recorded")
+	}
+
+	// Someone else taking the nick cannot forget the lines of bob.
+	network.MessageHandler(Speaker{Nick: "bob", Account: "mallory"}, "#debsquad", "paglop: oublie-moi tout", time.Now())
+	network.forgetting.Wait()
+	if len(readRecords(t, model.getSpeakerFilename("bob"))) != 1 ||
+		model.Speaker("bob").LineCount() != 1 {
+		t.Fatal("speaker forgotten on a nick")
+	}
+}
+
+func TestForgetFailureSavesSnapshot(t *testing.T) {
+	setupTestBot(t)
+	model := &Model{
+		Files:        DataFiles{Path: cfg.MarkovDataPath},
+		SnapshotPath: filepath.Join(cfg.MarkovDataPath, "chain.snapshot"),
+		Chain:        NewChain(2),
+	}
+	model.enableSpeakers(filepath.Join(cfg.MarkovDataPath, "speakers"))
+
+	model.Learn(LogRecord{Channel: "#debsquad", Nick: "bob", Account: "bobby", Kind: LogKindMessage, Text: "le chien dort sur le tapis"})
+	model.Learn(LogRecord{Channel: "#debsquad", Nick: "alice", Kind: LogKindMessage, Text: "le chat dort sur le canapé"})
+	model.Snapshot()
+
+	// The speaker log disappears before its rewrite is finished, after
+	// the autolog was rewritten.
+	seen := 0
+	forgotten, err := model.Forget(func(record LogRecord) bool {
+		if record.Account != "bobby" {
+			return false
+		}
+		if seen++; seen == 2 {
+			os.Remove(model.getSpeakerFilename("bob"))
+		}
+		return true
+	})
+	if err == nil || forgotten != 1 {
+		t.Fatalf("wrong outcome of a failed forget: %d, %v", forgotten, err)
+	}
+
+	chain, err := loadSnapshot(model.SnapshotPath, model.Files, 2)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	for word, count := range map[string]uint64{"chien": 0, "chat": 1} {
+		if score := chain.GetScoredWords(word)[0].Score; score != count {
+			t.Fatalf("outdated snapshot, wrong count for %s: %d", word, score)
+		}
+	}
+}
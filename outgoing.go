@@ -0,0 +1,234 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// IRC lines are limited to 512 bytes, CR-LF included (RFC 1459 section
+// 2.3).  When relayed, our messages are prefixed with our hostmask, which is
+// estimated from these limits until the server tells us.
+const (
+	maxLineLength   = 512
+	maxUserLength   = 10
+	maxHostLength   = 63
+	maxQueuedLines  = 20
+	actionOverhead  = len("\x01ACTION \x01")
+	privmsgOverhead = len(": PRIVMSG  :\r\n")
+)
+
+// outgoingLine is a line waiting in the OutgoingQueue.
+type outgoingLine struct {
+	target string
+	text   string
+	action bool
+}
+
+// tokenBucket allows burst lines at once, then one line per interval.
+type tokenBucket struct {
+	burst    float64
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(burst int, interval time.Duration) *tokenBucket {
+	return &tokenBucket{
+		burst:    float64(burst),
+		interval: interval,
+		tokens:   float64(burst),
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	if !b.last.IsZero() && b.interval > 0 {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+	}
+	if b.tokens > b.burst || b.interval <= 0 {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens * float64(b.interval))
+}
+
+// OutgoingQueue throttles the messages sent through a Transport with a token
+// bucket.  Each target has its own queue and they take turns, a chatty
+// channel cannot delay the answers on the others for long.
+type OutgoingQueue struct {
+	transport Transport
+	bucket    *tokenBucket
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	lines   map[string][]outgoingLine
+	targets []string
+	closed  bool
+}
+
+// NewOutgoingQueue returns a queue sending burst lines at once through
+// transport, then one line per interval.
+func NewOutgoingQueue(transport Transport, burst int, interval time.Duration) *OutgoingQueue {
+	q := &OutgoingQueue{
+		transport: transport,
+		bucket:    newTokenBucket(burst, interval),
+		lines:     make(map[string][]outgoingLine),
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Privmsg queues a message, split in as many lines as needed.
+func (q *OutgoingQueue) Privmsg(target, msg string) {
+	q.enqueue(target, msg, false)
+}
+
+// Action queues an action, split in as many lines as needed.
+func (q *OutgoingQueue) Action(target, msg string) {
+	q.enqueue(target, msg, true)
+}
+
+func (q *OutgoingQueue) enqueue(target, msg string, action bool) {
+	limit := lineLimit(q.transport.Nick(), q.transport.Hostmask(), target,
+		action)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, text := range splitMessage(msg, limit) {
+		if len(q.lines[target]) >= maxQueuedLines {
+			log.Printf("outgoing queue for %s is full, dropping: %s",
+				target, text)
+			continue
+		}
+		if len(q.lines[target]) == 0 {
+			q.targets = append(q.targets, target)
+		}
+		q.lines[target] = append(q.lines[target], outgoingLine{
+			target: target,
+			text:   text,
+			action: action,
+		})
+	}
+
+	q.cond.Signal()
+}
+
+// next waits for a line and returns it, targets are served in turns.  ok is
+// false once the queue is closed.
+func (q *OutgoingQueue) next() (line outgoingLine, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.targets) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return line, false
+	}
+
+	target := q.targets[0]
+	q.targets = q.targets[1:]
+	line = q.lines[target][0]
+	q.lines[target] = q.lines[target][1:]
+
+	if len(q.lines[target]) > 0 {
+		q.targets = append(q.targets, target)
+	} else {
+		delete(q.lines, target)
+	}
+
+	return line, true
+}
+
+// Run sends the queued lines until Close.
+func (q *OutgoingQueue) Run() {
+	for {
+		line, ok := q.next()
+		if !ok {
+			return
+		}
+
+		if wait := q.bucket.reserve(time.Now()); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		if line.action {
+			q.transport.Action(line.target, line.text)
+		} else {
+			q.transport.Privmsg(line.target, line.text)
+		}
+	}
+}
+
+// Close stops Run, the lines still queued are dropped.
+func (q *OutgoingQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// lineLimit returns how many bytes of text fit in a PRIVMSG to target, once
+// relayed by the server with our hostmask as prefix.  An unknown hostmask is
+// assumed to be as long as possible.
+func lineLimit(nick, hostmask, target string, action bool) int {
+	if hostmask == "" {
+		hostmask = nick + "!" + strings.Repeat("x", maxUserLength) +
+			"@" + strings.Repeat("x", maxHostLength)
+	}
+
+	limit := maxLineLength - privmsgOverhead - len(hostmask) - len(target)
+	if action {
+		limit -= actionOverhead
+	}
+
+	return limit
+}
+
+// splitMessage splits msg in lines of at most limit bytes, on new lines and
+// preferably between words, never in the middle of a UTF-8 character.
+func splitMessage(msg string, limit int) []string {
+	var lines []string
+
+	for _, line := range strings.Split(msg, "\n") {
+		line = strings.TrimSpace(line)
+		for len(line) > limit && limit > 0 {
+			cut := limit
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			if line[cut] != ' ' {
+				if space := strings.LastIndexByte(line[:cut], ' '); space > 0 {
+					cut = space
+				}
+			}
+			if cut == 0 {
+				// A single character longer than the limit.
+				_, cut = utf8.DecodeRuneInString(line)
+			}
+
+			lines = append(lines, strings.TrimSpace(line[:cut]))
+			line = strings.TrimSpace(line[cut:])
+		}
+
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// nullTransport is a disconnected Transport for the OutgoingQueue tests.
+type nullTransport struct {
+	nick     string
+	hostmask string
+}
+
+func (t *nullTransport) Connect() error             { return nil }
+func (t *nullTransport) Loop() error                { return nil }
+func (t *nullTransport) Nick() string               { return t.nick }
+func (t *nullTransport) Hostmask() string           { return t.hostmask }
+func (t *nullTransport) SetNick(nick string)        {}
+func (t *nullTransport) Join(channel string)        {}
+func (t *nullTransport) Privmsg(target, msg string) {}
+func (t *nullTransport) Action(target, msg string)  {}
+func (t *nullTransport) Quit()                      {}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		msg      string
+		limit    int
+		expected []string
+	}{
+		{"le chat", 10, []string{"le chat"}},
+		{"le chat\n\ndort\n", 10, []string{"le chat", "dort"}},
+		{"le chat dort", 7, []string{"le chat", "dort"}},
+		{"le chat dort", 8, []string{"le chat", "dort"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"ééééé", 5, []string{"éé", "éé", "é"}},
+		{"é", 1, []string{"é"}},
+	}
+
+	for _, test := range tests {
+		lines := splitMessage(test.msg, test.limit)
+		if !reflect.DeepEqual(lines, test.expected) {
+			t.Errorf("%q/%d: got %q", test.msg, test.limit, lines)
+		}
+	}
+}
+
+func TestSplitMessageIsUTF8Safe(t *testing.T) {
+	msg := strings.Repeat("le chaton a mangé 🐟 sur le canapé ", 40)
+
+	for limit := 4; limit < 100; limit++ {
+		lines := splitMessage(msg, limit)
+		for _, line := range lines {
+			if len(line) > limit || !utf8.ValidString(line) {
+				t.Fatalf("limit %d: invalid line %q", limit, line)
+			}
+		}
+		joined := strings.Replace(strings.Join(lines, ""), " ", "", -1)
+		if joined != strings.Replace(msg, " ", "", -1) {
+			t.Fatalf("limit %d: text lost", limit)
+		}
+	}
+}
+
+func TestLineLimit(t *testing.T) {
+	hostmask := "paglop!~paglop@example.org"
+	line := ":" + hostmask + " PRIVMSG #debsquad :"
+	if limit := lineLimit("paglop", hostmask, "#debsquad", false); len(line)+limit+2 != maxLineLength {
+		t.Fatalf("wrong limit: %d", limit)
+	}
+
+	action := lineLimit("paglop", hostmask, "#debsquad", true)
+	if action != lineLimit("paglop", hostmask, "#debsquad", false)-len("\x01ACTION \x01") {
+		t.Fatalf("wrong action limit: %d", action)
+	}
+
+	// Without hostmask, assume the longest one.
+	unknown := lineLimit("paglop", "", "#debsquad", false)
+	if unknown != maxLineLength-len(":paglop!@ PRIVMSG #debsquad :\r\n")-maxUserLength-maxHostLength {
+		t.Fatalf("wrong limit without hostmask: %d", unknown)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, time.Second)
+	now := time.Now()
+
+	for i, expected := range []time.Duration{0, 0, time.Second, 2 * time.Second} {
+		if wait := b.reserve(now); wait != expected {
+			t.Fatalf("reserve %d: waiting %s instead of %s", i, wait,
+				expected)
+		}
+	}
+
+	// The two reserved tokens and one more are available 3s later.
+	if wait := b.reserve(now.Add(3 * time.Second)); wait != 0 {
+		t.Fatalf("no token after 3s: %s", wait)
+	}
+
+	// The bucket does not fill up beyond its burst.
+	now = now.Add(time.Hour)
+	b.reserve(now)
+	b.reserve(now)
+	if wait := b.reserve(now); wait != time.Second {
+		t.Fatalf("burst exceeded: %s", wait)
+	}
+}
+
+func TestOutgoingQueueFairness(t *testing.T) {
+	q := NewOutgoingQueue(&nullTransport{nick: "paglop"}, 1, 0)
+	q.Privmsg("#a", "a1\na2\na3")
+	q.Action("#b", "b1\nb2")
+
+	var sent []string
+	for i := 0; i < 5; i++ {
+		line, ok := q.next()
+		if !ok {
+			t.Fatal("queue closed")
+		}
+		sent = append(sent, line.text)
+		if line.action != (line.target == "#b") {
+			t.Fatalf("wrong line kind: %+v", line)
+		}
+	}
+
+	expected := []string{"a1", "b1", "a2", "b2", "a3"}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("targets not served in turns: %q", sent)
+	}
+
+	q.Close()
+	if _, ok := q.next(); ok {
+		t.Fatal("line returned after close")
+	}
+}
+
+func TestOutgoingQueueLimit(t *testing.T) {
+	q := NewOutgoingQueue(&nullTransport{nick: "paglop"}, 1, 0)
+	q.Privmsg("#a", strings.Repeat("spam\n", 2*maxQueuedLines))
+
+	if len(q.lines["#a"]) != maxQueuedLines {
+		t.Fatalf("queue not limited: %d", len(q.lines["#a"]))
+	}
+}
+
+func TestNativeLongReplyIsSplit(t *testing.T) {
+	_, server := startNativeBot(t, "#debsquad")
+	server.Register("paglop")
+	server.Expect("JOIN #debsquad")
+	hostmask := "paglop!~paglop@" + strings.Repeat("h", 50) + ".example.org"
+	server.Send(":%s JOIN #debsquad", hostmask)
+
+	var words []string
+	for _, c := range "abcdefgh" {
+		words = append(words, strings.Repeat(string(c), 80))
+	}
+	long := strings.Join(words, " ")
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :%s", long)
+	server.Sync()
+
+	server.Send(":bob!~bob@example.org PRIVMSG #debsquad :paglop: %s", words[3])
+
+	var received []string
+	for len(strings.Join(received, " ")) < len(long) {
+		line := server.ReadLine()
+		if relayed := ":" + hostmask + " " + line + "\r\n"; len(relayed) > maxLineLength {
+			t.Fatalf("line too long once relayed (%d): %q",
+				len(relayed), line)
+		}
+		received = append(received,
+			strings.TrimPrefix(line, "PRIVMSG #debsquad :"))
+	}
+
+	if strings.Join(received, " ") != long {
+		t.Fatalf("wrong reply: %q", received)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"log"
+)
+
+// Supported SASL mechanisms.
+const (
+	SASLPlain    = "PLAIN"
+	SASLExternal = "EXTERNAL"
+)
+
+// SASL numerics (IRCv3 sasl-3.1)
+const (
+	ErrCodeNickLocked  = "902"
+	RplSASLSuccess     = "903"
+	ErrCodeSASLFail    = "904"
+	ErrCodeSASLTooLong = "905"
+	ErrCodeSASLAborted = "906"
+	ErrCodeSASLAlready = "907"
+	RplSASLMechs       = "908"
+)
+
+// saslChunkSize is the maximum length of an AUTHENTICATE argument, longer
+// responses are split over several commands.
+const saslChunkSize = 400
+
+// saslPayload returns the client response for the configured mechanism,
+// EXTERNAL relies on the TLS client certificate and sends nothing.
+func saslPayload(options TransportOptions) []byte {
+	if options.SASLMechanism != SASLPlain {
+		return nil
+	}
+
+	return []byte(options.SASLLogin + "\x00" + options.SASLLogin + "\x00" +
+		options.SASLPassword)
+}
+
+// saslResponse encodes payload into AUTHENTICATE arguments: base64 split in
+// chunks of 400 bytes, an empty response (or an empty chunk after a full one)
+// is sent as "+".
+func saslResponse(payload []byte) []string {
+	encoded := base64.StdEncoding.EncodeToString(payload)
+
+	var lines []string
+	for len(encoded) >= saslChunkSize {
+		lines = append(lines, encoded[:saslChunkSize])
+		encoded = encoded[saslChunkSize:]
+	}
+
+	if encoded == "" {
+		encoded = "+"
+	}
+
+	return append(lines, encoded)
+}
+
+// handleSASL runs the SASL exchange started once the server acknowledged the
+// sasl capability, the registration is resumed (CAP END) whatever its
+// outcome.
+func (t *nativeTransport) handleSASL(msg *Message) {
+	switch msg.Command {
+	case "AUTHENTICATE":
+		// We only support single-step mechanisms, the server tells us
+		// to go ahead with an empty challenge.
+		if msg.Param(0) != "+" {
+			return
+		}
+		for _, line := range saslResponse(saslPayload(t.options)) {
+			t.send("AUTHENTICATE " + line)
+		}
+
+	case RplSASLSuccess:
+		log.Printf("SASL authentication successful")
+		t.send("CAP END")
+
+	case RplSASLMechs:
+		log.Printf("SASL mechanisms available: %s", msg.Param(1))
+
+	default:
+		log.Printf("SASL authentication failed (%s): %s", msg.Command,
+			msg.Trailing())
+		t.send("CAP END")
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Secrets is the content of the secrets file, kept apart from the config so
+// the latter can be shared.
+type Secrets struct {
+	// NickServPassword is used to identify with NickServ and to regain
+	// the nick of the bot.
+	NickServPassword string
+
+	// SASLPassword is used if NetworkCfg.SASLPassword is not defined.
+	SASLPassword string
+
+	// Networks overrides the passwords above for the given networks.
+	Networks map[string]Secrets
+}
+
+var secrets = Secrets{}
+
+// For returns the secrets of the named network.
+func (s *Secrets) For(network string) Secrets {
+	override, ok := s.Networks[network]
+	if !ok {
+		return *s
+	}
+
+	if override.NickServPassword == "" {
+		override.NickServPassword = s.NickServPassword
+	}
+	if override.SASLPassword == "" {
+		override.SASLPassword = s.SASLPassword
+	}
+
+	return override
+}
+
+// parseSecretsFile loads the secrets file into the global secrets.
+func parseSecretsFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewDecoder(file).Decode(&secrets)
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Snapshot file layout: the magic string, a big-endian uint32 format version
+// and a gob-encoded snapshotData. The version must be bumped whenever the
+// layout of the Chain tables changes, older snapshots are then ignored and
+// the chain is rebuilt from the text files.
+const (
+	snapshotMagic   = "paglop-snapshot"
+	snapshotVersion = 5
+)
+
+var (
+	// ErrSnapshotFormat is returned when a snapshot file is not recognized.
+	ErrSnapshotFormat = errors.New("not a paglop snapshot")
+
+	// ErrSnapshotVersion is returned when a snapshot was written by an
+	// incompatible version of the bot.
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+
+	// ErrSnapshotOrder is returned when a snapshot was built for a
+	// different MarkovOrder than the one configured.
+	ErrSnapshotOrder = errors.New("snapshot has a different markov order")
+
+	// ErrSnapshotFiles is returned when a snapshot was built from data
+	// files which are no longer part of the model.
+	ErrSnapshotFiles = errors.New("snapshot has different data files")
+)
+
+// DataFiles selects the data files of a directory a chain is built from: all
+// the plain text (".txt") and structured log (".jsonl") files, or Only the
+// given names, minus the Excluded ones.  Names are given without extension
+// and follow the rfc1459 casemapping, like the channels they are named after.
+type DataFiles struct {
+	Path    string
+	Only    []string
+	Exclude []string
+}
+
+// Match returns true if the named file is one of the data files.
+func (files DataFiles) Match(name string) bool {
+	ext := filepath.Ext(name)
+	if ext != plainLogExt && ext != structuredLogExt {
+		return false
+	}
+
+	name = strings.TrimSuffix(name, ext)
+	if containsFold(files.Exclude, name) {
+		return false
+	}
+
+	return len(files.Only) == 0 || containsFold(files.Only, name)
+}
+
+// List returns the data files found in the directory.
+func (files DataFiles) List() ([]os.FileInfo, error) {
+	fileInfos, err := ioutil.ReadDir(files.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []os.FileInfo
+	for _, fileInfo := range fileInfos {
+		if files.Match(fileInfo.Name()) {
+			matching = append(matching, fileInfo)
+		}
+	}
+
+	return matching, nil
+}
+
+// snapshotData is the serialized content of a Chain. Offsets records the size
+// of every data file at the time of the snapshot, only lines written past
+// these offsets need to be replayed on load.
+type snapshotData struct {
+	LeaderLen int
+	Words     []string
+	Counts    []uint64
+	Forward   map[Tuple]Followers
+	Backward  map[Tuple]Followers
+	Index     map[WordID][]Tuple
+	Offsets   map[string]int64
+}
+
+// WriteSnapshot serializes the chain tables along with the given data file
+// offsets.
+func (chain *Chain) WriteSnapshot(w io.Writer, offsets map[string]int64) error {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+
+	err := binary.Write(w, binary.BigEndian, uint32(snapshotVersion))
+	if err != nil {
+		return err
+	}
+
+	return gob.NewEncoder(w).Encode(snapshotData{
+		LeaderLen: chain.leaderLen,
+		Words:     chain.dict.Words,
+		Counts:    chain.dict.Counts,
+		Forward:   chain.forward,
+		Backward:  chain.backward,
+		Index:     chain.index,
+		Offsets:   offsets,
+	})
+}
+
+// ReadSnapshot restores a Chain and its data file offsets from a snapshot.
+func ReadSnapshot(r io.Reader) (*Chain, map[string]int64, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, nil, ErrSnapshotFormat
+	}
+	if string(magic) != snapshotMagic {
+		return nil, nil, ErrSnapshotFormat
+	}
+
+	var version uint32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, nil, ErrSnapshotFormat
+	}
+	if version != snapshotVersion {
+		return nil, nil, ErrSnapshotVersion
+	}
+
+	var data snapshotData
+	if err := gob.NewDecoder(r).Decode(&data); err != nil {
+		return nil, nil, err
+	}
+
+	if len(data.Words) <= int(LineEndID) || len(data.Counts) != len(data.Words) {
+		return nil, nil, ErrSnapshotFormat
+	}
+
+	chain := NewChain(data.LeaderLen)
+	chain.dict = &Dictionary{Words: data.Words, Counts: data.Counts}
+	chain.dict.rebuildIndex()
+	if data.Forward != nil {
+		chain.forward = data.Forward
+	}
+	if data.Backward != nil {
+		chain.backward = data.Backward
+	}
+	if data.Index != nil {
+		chain.index = data.Index
+	}
+	if data.Offsets == nil {
+		data.Offsets = make(map[string]int64)
+	}
+
+	return chain, data.Offsets, nil
+}
+
+// getDataFileOffsets returns the current size of every data file.
+func getDataFileOffsets(files DataFiles) (map[string]int64, error) {
+	fileInfos, err := files.List()
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]int64)
+	for _, fileInfo := range fileInfos {
+		offsets[fileInfo.Name()] = fileInfo.Size()
+	}
+
+	return offsets, nil
+}
+
+// saveSnapshot writes the chain to filename, recording the offsets of its
+// data files.  The snapshot is written atomically so a crash never leaves a
+// truncated snapshot.  Learning must be held meanwhile, see Model.Snapshot.
+func saveSnapshot(chain *Chain, filename string, files DataFiles) error {
+	offsets, err := getDataFileOffsets(files)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, 0660, func(w io.Writer) error {
+		return chain.WriteSnapshot(w, offsets)
+	})
+}
+
+// loadSnapshot reads the snapshot at filename and replays every line added to
+// the data files since it was taken.  The snapshot is rejected if its leaders
+// are not made of order words, or if it was built from files which are no
+// longer data files (e.g. the log of a channel given its own model, or a
+// migrated legacy log).
+func loadSnapshot(filename string, files DataFiles, order int) (*Chain, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	chain, offsets, err := ReadSnapshot(bufio.NewReader(file))
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	if chain.leaderLen != order {
+		return nil, ErrSnapshotOrder
+	}
+
+	fileInfos, err := files.List()
+	if err != nil {
+		return nil, err
+	}
+
+	present := make(StringSet)
+	for _, fileInfo := range fileInfos {
+		present.Add(fileInfo.Name())
+	}
+	for name := range offsets {
+		if !present[name] {
+			return nil, ErrSnapshotFiles
+		}
+	}
+
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+
+		// A file smaller than recorded was truncated or rotated,
+		// consider its whole content as new.
+		offset := offsets[name]
+		if fileInfo.Size() < offset {
+			offset = 0
+		}
+		if fileInfo.Size() == offset {
+			continue
+		}
+
+		if err := replayFrom(chain, filepath.Join(files.Path, name), offset); err != nil {
+			return nil, err
+		}
+	}
+
+	return chain, nil
+}
+
+// replayFrom feeds the lines of filename starting at offset to the chain.
+func replayFrom(chain *Chain, filename string, offset int64) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	log.Printf("replaying %s from offset %d", filename, offset)
+	buildDataFile(chain, file, filename)
+
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	chain := NewChain(2)
+	chain.AddLine("I am not a number! I am a free man!")
+
+	var buf bytes.Buffer
+	offsets := map[string]int64{"autolog-#test.txt": 42}
+	if err := chain.WriteSnapshot(&buf, offsets); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, restoredOffsets, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(restored.forward, chain.forward) {
+		t.Fatal("forward table differs after restore")
+	}
+	if !reflect.DeepEqual(restored.backward, chain.backward) {
+		t.Fatal("backward table differs after restore")
+	}
+	if !reflect.DeepEqual(restored.dict, chain.dict) {
+		t.Fatal("dictionary differs after restore")
+	}
+	if !reflect.DeepEqual(restoredOffsets, offsets) {
+		t.Fatalf("wrong offsets: %v", restoredOffsets)
+	}
+}
+
+func TestSnapshotBadMagic(t *testing.T) {
+	_, _, err := ReadSnapshot(bytes.NewBufferString("not a snapshot at all"))
+	if err != ErrSnapshotFormat {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSnapshotReplaysNewLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paglop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logFile := filepath.Join(dir, "autolog-#test.txt")
+	snapshotFile := filepath.Join(dir, "chain.snapshot")
+
+	err = ioutil.WriteFile(logFile, []byte("the cat sat down\n"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := NewChain(2)
+	chain.AddLine("the cat sat down")
+	if err := saveSnapshot(chain, snapshotFile, DataFiles{Path: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("the dog ran away\n")
+	f.Close()
+
+	restored, err := loadSnapshot(snapshotFile, DataFiles{Path: dir}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.dict.Count("cat") != 1 {
+		t.Fatalf("snapshotted line replayed twice: cat=%d",
+			restored.dict.Count("cat"))
+	}
+	if restored.dict.Count("dog") != 1 {
+		t.Fatalf("new line not replayed: dog=%d",
+			restored.dict.Count("dog"))
+	}
+}
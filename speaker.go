@@ -0,0 +1,226 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// enableSpeakers makes the model log the records of every speaker apart in
+// path.  A new directory is first seeded with the records of the structured
+// logs of the model, so the speakers said before are known too.
+func (m *Model) enableSpeakers(path string) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = m.seedSpeakers(path)
+		if err != nil {
+			log.Fatalf("model %s: %s", m.Name, err.Error())
+		}
+	}
+	if err := os.MkdirAll(path, 0770); err != nil {
+		log.Fatalf("model %s: %s", m.Name, err.Error())
+	}
+
+	m.SpeakersPath = path
+	m.speakers = make(map[string]*Chain)
+}
+
+// seedSpeakers creates the speakers directory path from the records of the
+// structured logs of the model.  It is written aside and renamed once
+// complete, an interrupted seeding starts over on the next start.
+func (m *Model) seedSpeakers(path string) error {
+	tmp := path + ".seeding"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0770); err != nil {
+		return err
+	}
+
+	fileInfos, err := m.Files.List()
+	if err != nil {
+		return err
+	}
+
+	for _, fileInfo := range fileInfos {
+		if filepath.Ext(fileInfo.Name()) != structuredLogExt {
+			continue
+		}
+
+		filename := filepath.Join(m.Files.Path, fileInfo.Name())
+		log.Printf("model %s: seeding the speakers from %s", m.Name,
+			filename)
+		if err := seedSpeakersFrom(tmp, filename); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// seedSpeakersFrom appends the records of the structured log filename to the
+// logs of their speakers in path.  Records without nick (e.g. migrated from
+// the plain text logs) are skipped.
+func seedSpeakersFrom(path, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lines := make(map[string][]string)
+	scanRecords(file, func(record LogRecord) {
+		if record.Nick == "" {
+			return
+		}
+		encoded, err := encodeRecord(record)
+		if err != nil {
+			return
+		}
+		target := getSpeakerFilename(path, record.Nick)
+		lines[target] = append(lines[target], encoded+"\n")
+	})
+
+	for target, records := range lines {
+		f, err := os.OpenFile(target,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, strings.Join(records, ""))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getSpeakerFilename returns the path of the structured log of the given
+// speaker in path, nicks follow the rfc1459 casemapping.
+func getSpeakerFilename(path, nick string) string {
+	name := logFilenameReplacer.Replace(ircLower(nick))
+	return filepath.Join(path, name+structuredLogExt)
+}
+
+// getSpeakerFilename returns the path of the structured log of the given
+// speaker of the model.
+func (m *Model) getSpeakerFilename(nick string) string {
+	return getSpeakerFilename(m.SpeakersPath, nick)
+}
+
+// Speaker returns the chain of the lines of nick, or nil if nick was never
+// heard.  It is built from the log of the speaker on first use, then learns
+// along with the model.
+func (m *Model) Speaker(nick string) *Chain {
+	for {
+		chain, rewritten := m.loadSpeaker(nick)
+		if !rewritten {
+			return chain
+		}
+	}
+}
+
+// loadSpeaker returns the chain of nick, built if needed, see Speaker.  The
+// log is read without blocking the learning, up to its size when the build
+// started, the lines logged meanwhile are replayed once locked again.  If
+// the log was rewritten meanwhile (see Model.Forget), the chain is dropped
+// and rewritten is true.
+func (m *Model) loadSpeaker(nick string) (chain *Chain, rewritten bool) {
+	key := ircLower(nick)
+	filename := m.getSpeakerFilename(nick)
+
+	m.mutex.Lock()
+	chain, ok := m.speakers[key]
+	fileInfo, err := os.Stat(filename)
+	m.mutex.Unlock()
+
+	if ok {
+		return chain, false
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("unable to load speaker %s: %s", nick,
+				err.Error())
+		}
+		return nil, false
+	}
+
+	chain = NewChain(m.Chain.leaderLen)
+	chain.SetSubstringMatch(cfg.MarkovSubstringMatch)
+	if err := buildSpeaker(chain, filename, fileInfo.Size()); err != nil {
+		log.Printf("unable to load speaker %s: %s", nick, err.Error())
+		return nil, false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if cached, ok := m.speakers[key]; ok {
+		return cached, false
+	}
+	current, err := os.Stat(filename)
+	if err != nil || !os.SameFile(fileInfo, current) {
+		return nil, true
+	}
+	if current.Size() > fileInfo.Size() {
+		err = replayFrom(chain, filename, fileInfo.Size())
+		if err != nil {
+			log.Printf("unable to load speaker %s: %s", nick,
+				err.Error())
+			return nil, false
+		}
+	}
+
+	m.speakers[key] = chain
+	return chain, false
+}
+
+// buildSpeaker adds the records of the first size bytes of the speaker log
+// filename to the chain.
+func buildSpeaker(chain *Chain, filename string, size int64) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	chain.BuildRecords(io.LimitReader(file, size))
+	return nil
+}
+
+// imitate answers on target in the style of nick, from the lines nick said
+// there, unless there are too few of them or nick opted out.
+func (n *Network) imitate(target, nick, topic string) {
+	if optOuts.Has(n.config.Name, Speaker{Nick: nick}) {
+		n.sendMessage(target, fmt.Sprintf("%s ne veut pas", nick))
+		return
+	}
+
+	chain := n.models.Learner(target).Speaker(nick)
+	if chain == nil || chain.LineCount() < uint64(cfg.SpeakerMinLines) {
+		n.sendMessage(target, fmt.Sprintf("je ne connais pas assez %s",
+			nick))
+		return
+	}
+
+	seed, topic := parseSeed(chain, topic)
+	log.Printf("imitating %s on %q with seed %d", nick, topic, seed)
+	n.rememberSeed(target, fmt.Sprintf("imite %s seed %d %s", nick, seed,
+		topic))
+
+	chain = chain.WithSeed(seed)
+	if topic == "" {
+		n.answer(target, chain.Generate(20))
+		return
+	}
+	n.answer(target, chain.GenerateOnTopic(10, topic))
+}
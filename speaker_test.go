@@ -0,0 +1,151 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupSpeakers returns a bot recording its speakers, which heard bob twice
+// and alice once.
+func setupSpeakers(t *testing.T) (*Network, *bytes.Buffer) {
+	network, output := setupTestBot(t)
+	cfg.SpeakerMinLines = 3
+	network.models.shared.enableSpeakers(filepath.Join(cfg.MarkovDataPath,
+		"speakers"))
+
+	for _, line := range []struct{ nick, body string }{
+		{"alice", "le chien mange sa gamelle"},
+		{"Bob", "le chat mange la souris"},
+		{"bob", "la souris mange le fromage"},
+	} {
+		network.MessageHandler(Speaker{Nick: line.nick}, "#debsquad",
+			line.body, time.Now())
+	}
+	output.Reset()
+
+	return network, output
+}
+
+func TestImitateNotEnoughLines(t *testing.T) {
+	network, output := setupSpeakers(t)
+
+	network.MessageHandler(Speaker{Nick: "alice"}, "#debsquad", "paglop: imite bob souris", time.Now())
+	if output.String() != "PRIVMSG #debsquad :je ne connais pas assez bob\n" {
+		t.Fatalf("imitated with too few lines: %q", output.String())
+	}
+}
+
+func TestImitate(t *testing.T) {
+	network, output := setupSpeakers(t)
+	network.MessageHandler(Speaker{Nick: "BOB"}, "#debsquad", "le fromage mange la souris", time.Now())
+
+	for seed := 0; seed < 10; seed++ {
+		output.Reset()
+		network.replyLoops = newLoopDetector()
+		network.MessageHandler(Speaker{Nick: "alice"}, "#debsquad",
+			"paglop: imite bob seed "+strconv.Itoa(seed)+" mange",
+			time.Now())
+
+		answer := strings.TrimPrefix(output.String(), "PRIVMSG #debsquad :")
+		if answer == output.String() || !strings.Contains(answer, "mange") {
+			t.Fatalf("wrong imitation: %q", output.String())
+		}
+		for _, word := range []string{"chien", "gamelle", "canapé"} {
+			if strings.Contains(answer, word) {
+				t.Fatalf("imitation with words of others: %q", answer)
+			}
+		}
+	}
+
+	// Without topic, anything bob said will do.
+	output.Reset()
+	network.replyLoops = newLoopDetector()
+	network.MessageHandler(Speaker{Nick: "alice"}, "#debsquad", "paglop: imite bob", time.Now())
+	if !strings.HasPrefix(output.String(), "PRIVMSG #debsquad :l") {
+		t.Fatalf("wrong imitation without topic: %q", output.String())
+	}
+}
+
+func TestSpeakerRestored(t *testing.T) {
+	network, _ := setupSpeakers(t)
+
+	model := &Model{Chain: NewChain(2)}
+	model.enableSpeakers(network.models.shared.SpeakersPath)
+	if lines := model.Speaker("BoB").LineCount(); lines != 2 {
+		t.Fatalf("wrong number of lines restored for bob: %d", lines)
+	}
+	if model.Speaker("carol") != nil {
+		t.Fatal("chain built for an unknown speaker")
+	}
+	if _, ok := model.speakers["carol"]; ok {
+		t.Fatal("unknown speaker cached")
+	}
+}
+
+func TestImitateDisabled(t *testing.T) {
+	network, output := setupTestBot(t)
+	network.models.shared.Chain.AddLine("imite le chat")
+
+	network.MessageHandler(Speaker{Nick: "alice"}, "#debsquad", "paglop: imite bob", time.Now())
+	if strings.Contains(output.String(), "je ne connais pas") {
+		t.Fatalf("imitation without speaker models: %q", output.String())
+	}
+}
+
+func TestSpeakersSeededFromLogs(t *testing.T) {
+	network, _ := setupTestBot(t)
+	model := network.models.shared
+	for _, record := range []LogRecord{
+		{Channel: "#debsquad", Nick: "bob", Kind: LogKindMessage, Text: "le chat mange la souris"},
+		{Channel: "#debsquad", Nick: "alice", Kind: LogKindMessage, Text: "le chien mange sa gamelle"},
+		{Channel: "#work", Nick: "Bob", Account: "bobby", Kind: LogKindAction, Text: "mange le fromage"},
+		{Channel: "#debsquad", Kind: LogKindMessage, Text: "une ligne migrée"},
+	} {
+		appendRecord(model.getLogFilename(record.Channel), record)
+	}
+
+	path := filepath.Join(cfg.MarkovDataPath, "speakers")
+	model.enableSpeakers(path)
+	if lines := model.Speaker("bob").LineCount(); lines != 2 {
+		t.Fatalf("wrong number of lines seeded for bob: %d", lines)
+	}
+	records := readRecords(t, model.getSpeakerFilename("bob"))
+	if len(records) != 2 || records[1].Account != "bobby" {
+		t.Fatalf("wrong records seeded for bob: %+v", records)
+	}
+
+	// An existing directory is left alone.
+	appendRecord(model.getLogFilename("#debsquad"), LogRecord{Channel: "#debsquad", Nick: "carol", Kind: LogKindMessage, Text: "le hibou dort"})
+	model.enableSpeakers(path)
+	if model.Speaker("carol") != nil {
+		t.Fatal("speakers seeded again")
+	}
+}
+
+func TestSpeakersCasemapping(t *testing.T) {
+	network, output := setupSpeakers(t)
+	model := network.models.shared
+
+	network.MessageHandler(Speaker{Nick: "bob[", Account: "bobby"}, "#debsquad", "le chat dort sur le canapé", time.Now())
+	network.MessageHandler(Speaker{Nick: "BOB{", Account: "bobby"}, "#debsquad", "le chat dort encore", time.Now())
+	if lines := model.Speaker("Bob{").LineCount(); lines != 2 {
+		t.Fatalf("bob[ and BOB{ recorded apart: %d lines", lines)
+	}
+	if model.getSpeakerFilename("bob[") != model.getSpeakerFilename("BOB{") {
+		t.Fatal("bob[ and BOB{ logged apart")
+	}
+
+	network.MessageHandler(Speaker{Nick: "bob["}, "#debsquad", "paglop: ne m'apprends pas", time.Now())
+	output.Reset()
+	network.MessageHandler(Speaker{Nick: "BOB{"}, "#debsquad", "le chien dort", time.Now())
+	if model.Chain.GetScoredWords("chien")[0].Score != 1 {
+		t.Fatal("learned from BOB{ after bob[ opted out")
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default reconnection back-off: the delay doubles after every failed attempt
+// and a random jitter of up to half the delay is removed from it.
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 5 * time.Minute
+	reconnectHistory  = 10
+)
+
+// ReconnectEvent records a lost connection.
+type ReconnectEvent struct {
+	Time  time.Time
+	Error string
+	Delay time.Duration
+}
+
+// Supervisor keeps the bot connected: it reconnects the Transport whenever
+// the connection is lost and keeps track of the channels to rejoin.
+type Supervisor struct {
+	minDelay time.Duration
+	maxDelay time.Duration
+
+	mutex          sync.Mutex
+	channels       map[string]string
+	history        []ReconnectEvent
+	reconnects     int
+	attempts       int
+	connectedSince time.Time
+}
+
+// NewSupervisor returns a Supervisor with the default back-off delays.
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		minDelay: reconnectMinDelay,
+		maxDelay: reconnectMaxDelay,
+		channels: make(map[string]string),
+	}
+}
+
+// Run connects the transport and reconnects it every time the connection is
+// lost, until it ends cleanly (Loop returning nil after a Quit).  flush is
+// called after every lost connection.
+func (s *Supervisor) Run(t Transport, flush func()) {
+	for {
+		err := t.Connect()
+		if err == nil {
+			err = t.Loop()
+			if err == nil {
+				return
+			}
+		}
+
+		// Save the chain while we are not busy talking.
+		flush()
+
+		delay := s.disconnected(err)
+		log.Printf("connection lost (%s), reconnecting in %s",
+			err.Error(), delay)
+		time.Sleep(delay)
+	}
+}
+
+// disconnected records a lost connection and returns how long to wait before
+// the next attempt.
+func (s *Supervisor) disconnected(err error) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delay := s.minDelay << uint(s.attempts)
+	if delay > s.maxDelay || delay <= 0 {
+		delay = s.maxDelay
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay -= time.Duration(rand.Int63n(half))
+	}
+	s.attempts++
+	s.reconnects++
+	s.connectedSince = time.Time{}
+
+	s.history = append(s.history, ReconnectEvent{
+		Time:  time.Now(),
+		Error: err.Error(),
+		Delay: delay,
+	})
+	if len(s.history) > reconnectHistory {
+		s.history = s.history[1:]
+	}
+
+	return delay
+}
+
+// Welcomed resets the back-off once the server accepted the bot.
+func (s *Supervisor) Welcomed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.attempts > 0 {
+		log.Printf("reconnected after %d attempt(s), %d reconnect(s) "+
+			"so far", s.attempts, s.reconnects)
+	}
+	s.attempts = 0
+	s.connectedSince = time.Now()
+}
+
+// Connected returns true once the server welcomed the bot, until the
+// connection is lost.
+func (s *Supervisor) Connected() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.connectedSince.IsZero()
+}
+
+// Joined records that the bot is in channel.  Channels are tracked by their
+// casemapped name, keeping the casing of the first JOIN.
+func (s *Supervisor) Joined(channel string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.channels[ircLower(channel)]; !ok {
+		s.channels[ircLower(channel)] = channel
+	}
+}
+
+// Parted records that the bot left (or was kicked from) channel.
+func (s *Supervisor) Parted(channel string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.channels, ircLower(channel))
+}
+
+// Channels returns the channels the bot joined so far, sorted.
+func (s *Supervisor) Channels() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	channels := make([]string, 0, len(s.channels))
+	for _, channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// History returns the most recent lost connections, oldest first.
+func (s *Supervisor) History() []ReconnectEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]ReconnectEvent(nil), s.history...)
+}
+
+// Status returns a one-line summary of the connection, used to answer the
+// status command.  It is sent to the channels, so it only tells when the last
+// connection was lost, the errors may reveal the setup of the bot and are
+// only logged.
+func (s *Supervisor) Status() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := "not connected"
+	if !s.connectedSince.IsZero() {
+		uptime := time.Since(s.connectedSince) / time.Second * time.Second
+		status = "connected for " + uptime.String()
+	}
+
+	status += fmt.Sprintf(", %d reconnect(s)", s.reconnects)
+	if n := len(s.history); n > 0 {
+		last := s.history[n-1]
+		ago := time.Since(last.Time) / time.Second * time.Second
+		status += fmt.Sprintf(", last one %s ago", ago)
+	}
+
+	return status
+}
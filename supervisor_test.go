@@ -0,0 +1,62 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSupervisorBackoff(t *testing.T) {
+	s := NewSupervisor()
+	s.minDelay = time.Second
+	s.maxDelay = 10 * time.Second
+	lost := errors.New("lost")
+
+	for i, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		max *= time.Second
+		delay := s.disconnected(lost)
+		if delay <= max/2 || delay > max {
+			t.Fatalf("attempt %d: delay %s not in ]%s, %s]", i, delay,
+				max/2, max)
+		}
+	}
+
+	// Back to the minimum delay once connected.
+	s.Welcomed()
+	if delay := s.disconnected(lost); delay > time.Second {
+		t.Fatalf("delay not reset after welcome: %s", delay)
+	}
+
+	if len(s.History()) != 7 {
+		t.Fatalf("wrong history length: %d", len(s.History()))
+	}
+}
+
+func TestSupervisorHistoryIsBounded(t *testing.T) {
+	s := NewSupervisor()
+	for i := 0; i < 2*reconnectHistory; i++ {
+		s.disconnected(errors.New("lost"))
+	}
+
+	if len(s.History()) != reconnectHistory {
+		t.Fatalf("history not bounded: %d", len(s.History()))
+	}
+}
+
+func TestSupervisorChannelsCasemapping(t *testing.T) {
+	s := NewSupervisor()
+	s.Joined("#Debsquad")
+	s.Joined("#debsquad")
+	s.Joined("#[paglop]")
+	s.Joined("#gone")
+	s.Parted("#GONE")
+	s.Parted("#{PAGLOP}")
+
+	channels := s.Channels()
+	if len(channels) != 1 || channels[0] != "#Debsquad" {
+		t.Fatalf("wrong channels: %v", channels)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNativeTLSWithCustomCA(t *testing.T) {
+	server, caFile := newFakeTLSServer(t)
+	config, err := newTLSConfig(server.Addr(), caFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connectNativeBot(t, server, TransportOptions{
+		Server:    server.Addr(),
+		Nick:      "paglop",
+		TLSConfig: config,
+	}, "#debsquad")
+
+	server.Register("paglop")
+	server.Expect("JOIN #debsquad")
+
+	if len(server.PeerCertificates()) != 0 {
+		t.Fatal("client certificate sent without being configured")
+	}
+}
+
+func TestNativeTLSClientCertificate(t *testing.T) {
+	server, _ := newFakeTLSServer(t)
+	_, certFile, keyFile := newTestCertificate(t, "paglop")
+	config, err := newTLSConfig(server.Addr(), "", certFile, keyFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connectNativeBot(t, server, TransportOptions{
+		Server:    server.Addr(),
+		Nick:      "paglop",
+		TLSConfig: config,
+	})
+	server.Register("paglop")
+
+	certs := server.PeerCertificates()
+	if len(certs) != 1 || certs[0].Subject.CommonName != "paglop" {
+		t.Fatalf("wrong client certificate: %v", certs)
+	}
+}
+
+func TestNativeTLSUnknownAuthority(t *testing.T) {
+	setupTestBot(t)
+	server, _ := newFakeTLSServer(t)
+	config, err := newTLSConfig(server.Addr(), "", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := newNativeTransport(TransportOptions{
+		Server:    server.Addr(),
+		Nick:      "paglop",
+		TLSConfig: config,
+	}, EventHandlers{})
+	if err := transport.Connect(); err == nil {
+		t.Fatal("self-signed certificate accepted")
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	_, certFile, keyFile := newTestCertificate(t, "paglop")
+
+	if _, err := newTLSConfig("irc.example.org:6697", keyFile, "", "", false); err == nil {
+		t.Fatal("CA file without certificate accepted")
+	}
+
+	if _, err := newTLSConfig("irc.example.org:6697", "", certFile, certFile, false); err == nil {
+		t.Fatal("certificate without key accepted")
+	}
+
+	config, err := newTLSConfig("irc.example.org:6697", certFile, certFile, keyFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerName != "irc.example.org" {
+		t.Fatalf("wrong server name: %s", config.ServerName)
+	}
+}
+
+func TestSASLResponse(t *testing.T) {
+	for _, test := range []struct {
+		payloadLen int
+		chunks     []int
+	}{
+		{0, []int{1}},
+		{3, []int{4}},
+		{300, []int{400, 1}},
+		{301, []int{400, 4}},
+		{600, []int{400, 400, 1}},
+	} {
+		lines := saslResponse(bytes.Repeat([]byte("x"), test.payloadLen))
+		if len(lines) != len(test.chunks) {
+			t.Fatalf("payload %d: wrong chunks: %q", test.payloadLen, lines)
+		}
+		for i, line := range lines {
+			if len(line) != test.chunks[i] {
+				t.Fatalf("payload %d: wrong chunks: %q",
+					test.payloadLen, lines)
+			}
+		}
+		if last := lines[len(lines)-1]; len(last) == 1 && last != "+" {
+			t.Fatalf("payload %d: wrong terminator: %q",
+				test.payloadLen, last)
+		}
+	}
+}
+
+func TestNativeSASLPlain(t *testing.T) {
+	server, caFile := newFakeTLSServer(t)
+	config, err := newTLSConfig(server.Addr(), caFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connectNativeBot(t, server, TransportOptions{
+		Server:        server.Addr(),
+		Nick:          "paglop",
+		TLSConfig:     config,
+		SASLMechanism: SASLPlain,
+		SASLLogin:     "paglop",
+		SASLPassword:  "hunter2",
+	}, "#debsquad")
+
+	server.Expect("CAP LS 302")
+	server.Expect("NICK paglop")
+	server.Expect("USER paglop localhost 127.0.0.1 :paglop")
+	server.Send(":irc.example.org CAP * LS :sasl=PLAIN,EXTERNAL")
+	server.Expect("CAP REQ :sasl")
+	server.Send(":irc.example.org CAP * ACK :sasl")
+	server.Expect("AUTHENTICATE PLAIN")
+	server.Send("AUTHENTICATE +")
+	// base64("paglop\x00paglop\x00hunter2")
+	server.Expect("AUTHENTICATE cGFnbG9wAHBhZ2xvcABodW50ZXIy")
+	server.Send(":irc.example.org 900 paglop paglop!paglop@example.org paglop :You are now logged in as paglop")
+	server.Send(":irc.example.org 903 paglop :SASL authentication successful")
+	server.Expect("CAP END")
+	server.Send(":irc.example.org 001 paglop :Welcome")
+	server.Expect("JOIN #debsquad")
+}
+
+func TestNativeSASLExternal(t *testing.T) {
+	server, caFile := newFakeTLSServer(t)
+	_, certFile, keyFile := newTestCertificate(t, "paglop")
+	config, err := newTLSConfig(server.Addr(), caFile, certFile, keyFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connectNativeBot(t, server, TransportOptions{
+		Server:        server.Addr(),
+		Nick:          "paglop",
+		TLSConfig:     config,
+		SASLMechanism: SASLExternal,
+	})
+
+	server.Expect("CAP LS 302")
+	server.Expect("NICK paglop")
+	server.Expect("USER paglop localhost 127.0.0.1 :paglop")
+	if len(server.PeerCertificates()) != 1 {
+		t.Fatal("no client certificate for SASL EXTERNAL")
+	}
+	server.Send(":irc.example.org CAP * LS :sasl")
+	server.Expect("CAP REQ :sasl")
+	server.Send(":irc.example.org CAP * ACK :sasl")
+	server.Expect("AUTHENTICATE EXTERNAL")
+	server.Send("AUTHENTICATE +")
+	server.Expect("AUTHENTICATE +")
+	server.Send(":irc.example.org 903 paglop :SASL authentication successful")
+	server.Expect("CAP END")
+}
+
+func TestNativeSASLFailure(t *testing.T) {
+	server := newFakeServer(t)
+	connectNativeBot(t, server, TransportOptions{
+		Server:        server.Addr(),
+		Nick:          "paglop",
+		SASLMechanism: SASLPlain,
+		SASLLogin:     "paglop",
+		SASLPassword:  "wrong",
+	})
+
+	server.Expect("CAP LS 302")
+	server.Expect("NICK paglop")
+	server.Expect("USER paglop localhost 127.0.0.1 :paglop")
+	server.Send(":irc.example.org CAP * LS :sasl=PLAIN,EXTERNAL")
+	server.Expect("CAP REQ :sasl")
+	server.Send(":irc.example.org CAP * ACK :sasl")
+	server.Expect("AUTHENTICATE PLAIN")
+	server.Send("AUTHENTICATE +")
+	server.ReadLine()
+	server.Send(":irc.example.org 904 paglop :SASL authentication failed")
+	server.Expect("CAP END")
+}
+
+func TestNativeSASLNotSupported(t *testing.T) {
+	server := newFakeServer(t)
+	connectNativeBot(t, server, TransportOptions{
+		Server:        server.Addr(),
+		Nick:          "paglop",
+		SASLMechanism: SASLPlain,
+		SASLLogin:     "paglop",
+		SASLPassword:  "hunter2",
+	})
+
+	// Without sasl, the registration is not held.
+	server.Register("paglop", "server-time")
+}
+
+func TestSASLExternalRequiresNative(t *testing.T) {
+	network := NetworkCfg{
+		IRCServer:     "irc.example.org:6697",
+		IRCNickname:   "paglop",
+		IRCUseTLS:     true,
+		TLSCertFile:   "paglop.pem",
+		TLSKeyFile:    "paglop.key",
+		SASLMechanism: SASLExternal,
+	}
+	if err := network.setDefaults(); err == nil {
+		t.Fatal("SASL EXTERNAL accepted with go-ircevent")
+	}
+
+	network.Transport = TransportNative
+	if err := network.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+}
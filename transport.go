@@ -0,0 +1,99 @@
+// Copyright (c) 2015 Bertrand Janin <b@janin.com>
+// Use of this source code is governed by the ISC license in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// Available transports, selected with Cfg.Transport.
+const (
+	TransportIRCEvent = "ircevent"
+	TransportNative   = "native"
+)
+
+// TransportOptions define how a Transport connects and registers.
+type TransportOptions struct {
+	// Server is the host:port to dial.
+	Server string
+
+	// Nick is the nick requested upon registration.
+	Nick string
+
+	// TLSConfig enables TLS when set.
+	TLSConfig *tls.Config
+
+	// SASLMechanism enables SASL authentication when set ("PLAIN" or
+	// "EXTERNAL"), SASLLogin and SASLPassword are only used by PLAIN.
+	SASLMechanism string
+	SASLLogin     string
+	SASLPassword  string
+
+	// Quiet disables the protocol logs of the transports unable to hide
+	// the passwords from them (go-ircevent).
+	Quiet bool
+}
+
+// EventHandlers are the functions called by a Transport upon IRC events.  They
+// are called from the goroutine running Loop, nil handlers are skipped.
+type EventHandlers struct {
+	// Welcome is called once registered with the server (001).
+	Welcome func()
+
+	// Message is called for every PRIVMSG, target is either a channel or
+	// our own nick for private messages.  at is when the server received
+	// it (server-time) or when we did.
+	Message func(speaker Speaker, target, body string, at time.Time)
+
+	// Action is called for every CTCP ACTION (/me).
+	Action func(speaker Speaker, target, body string, at time.Time)
+
+	// NickChanged is called when the nick of the bot changed.
+	NickChanged func(nick string)
+
+	// Joined and Parted are called when the bot enters or leaves (or is
+	// kicked from) a channel.
+	Joined func(channel string)
+	Parted func(channel string)
+}
+
+// Transport is a connection to an IRC server.
+type Transport interface {
+	// Connect dials the server and registers the bot.
+	Connect() error
+
+	// Loop processes the server events until the connection is over, it
+	// returns nil only if the connection ended with Quit.
+	Loop() error
+
+	// Nick returns the current nick of the bot, which may differ from
+	// the configured one if it was taken.
+	Nick() string
+
+	// Hostmask returns our nick!user@host as seen by the others, or an
+	// empty string until the server told us.
+	Hostmask() string
+
+	// SetNick asks the server to change our nick.
+	SetNick(nick string)
+
+	Join(channel string)
+	Privmsg(target, msg string)
+	Action(target, msg string)
+	Quit()
+}
+
+// newTransport returns the Transport selected by name.
+func newTransport(name string, options TransportOptions, handlers EventHandlers) (Transport, error) {
+	switch name {
+	case "", TransportIRCEvent:
+		return newIRCEventTransport(options, handlers), nil
+	case TransportNative:
+		return newNativeTransport(options, handlers), nil
+	}
+
+	return nil, fmt.Errorf("unknown transport: %s", name)
+}